@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// access is the access a rule grants to the keys it matches, a bit set.
+type access int
+
+const (
+	accessNone      access = 0
+	accessRead      access = 1
+	accessWriteOnly access = 2 // only from etcd's own permissions
+	accessWrite            = accessRead | accessWriteOnly
+	accessDeny      access = 4 // overrides the other rules of the same specificity
+)
+
+var accessNames = map[string]access{"read": accessRead, "write": accessWrite, "deny": accessDeny}
+
+// accessRule grants access to a key, to all keys under a prefix, or to a key
+// range as in etcd's own permissions.
+type accessRule struct {
+	prefix string
+	exact  bool
+	end    string // the keys in [prefix, end), "\x00" = no end
+	access access
+}
+
+// parseAccessRule parses a rule like "read /config/**". A pattern ending with
+// ** matches all the keys with the prefix before it, any other is a key.
+func parseAccessRule(s string) (accessRule, error) {
+	name, pattern, _ := strings.Cut(strings.TrimSpace(s), " ")
+	a, found := accessNames[name]
+	pattern = strings.TrimSpace(pattern)
+	if !found || pattern == "" {
+		return accessRule{}, fmt.Errorf("invalid rule %q, expected read|write|deny <pattern>", s)
+	}
+	prefix, isPrefix := strings.CutSuffix(pattern, "**")
+	if strings.Contains(prefix, "*") {
+		return accessRule{}, fmt.Errorf("invalid rule %q, only a trailing ** is supported", s)
+	}
+	return accessRule{prefix: prefix, exact: !isPrefix, access: a}, nil
+}
+
+// accessRules is the access control configuration: rules by role, and roles
+// by user and by group. A group with the name of a role also has the role.
+type accessRules struct {
+	Roles   map[string][]string `json:"roles"`   // rules by role name
+	Users   map[string][]string `json:"users"`   // roles by user name
+	Groups  map[string][]string `json:"groups"`  // roles by group
+	Default []string            `json:"default"` // roles of every user
+	rules   map[string][]accessRule
+}
+
+func loadAccessRules(path string) (*accessRules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a accessRules
+	if err = json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	a.rules = map[string][]accessRule{}
+	for role, rules := range a.Roles {
+		for _, s := range rules {
+			rule, err := parseAccessRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: role %s: %w", path, role, err)
+			}
+			a.rules[role] = append(a.rules[role], rule)
+		}
+	}
+	for _, roles := range slices.Concat(slices.Collect(maps.Values(a.Users)), slices.Collect(maps.Values(a.Groups)), [][]string{a.Default}) {
+		for _, role := range roles {
+			if _, found := a.Roles[role]; !found {
+				return nil, fmt.Errorf("%s: unknown role %q", path, role)
+			}
+		}
+	}
+	return &a, nil
+}
+
+// forUser returns the permissions of a user, nil for unrestricted access when
+// there are no access rules. A nil user only has the default roles. Proxy and
+// OIDC users are prefixed with proxy: and oidc: in Users, so that they can't
+// take the roles of a local user.
+func (a *accessRules) forUser(u *User) *permissions {
+	if a == nil {
+		return nil
+	}
+	roles := slices.Clone(a.Default)
+	if u != nil {
+		name := u.Name
+		if u.ruleName != "" {
+			name = u.ruleName
+		}
+		roles = append(roles, a.Users[name]...)
+		for _, g := range u.Groups {
+			roles = append(roles, a.Groups[g]...)
+			if _, found := a.Roles[g]; found {
+				roles = append(roles, g)
+			}
+		}
+	}
+	p := &permissions{}
+	slices.Sort(roles)
+	for _, role := range slices.Compact(roles) {
+		p.rules = append(p.rules, a.rules[role]...)
+	}
+	return p
+}
+
+// permissions are the combined rules of a user's roles. The most specific
+// rule matching a key applies, or with union, the one granting most. Keys no
+// rule matches are denied. A nil *permissions allows everything.
+type permissions struct {
+	rules []accessRule
+	union bool // etcd's semantics, no deny rules
+}
+
+// specificity orders the rules matching the same key.
+func (r *accessRule) specificity() int {
+	if r.exact {
+		return 2*len(r.prefix) + 1
+	}
+	return 2 * len(r.prefix)
+}
+
+func (r *accessRule) matches(key string) bool {
+	switch {
+	case r.exact:
+		return key == r.prefix
+	case r.end != "":
+		return key >= r.prefix && (r.end == "\x00" || key < r.end)
+	}
+	return strings.HasPrefix(key, r.prefix)
+}
+
+// accessTo returns the access to key.
+func (p *permissions) accessTo(key string) access {
+	best, res := -1, accessNone
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !r.matches(key) {
+			continue
+		}
+		if p.union {
+			res |= r.access
+		} else if s := r.specificity(); s > best || (s == best && r.access > res) {
+			best, res = s, r.access
+		}
+	}
+	return res
+}
+
+func (p *permissions) canRead(key string) bool {
+	if p == nil {
+		return true
+	}
+	return p.accessTo(key)&accessRead != 0
+}
+
+func (p *permissions) canWrite(key string) bool {
+	return p == nil || p.accessTo(key)&accessWriteOnly != 0
+}
+
+// canList tells whether any key under prefix may be readable, and whether all
+// of them are.
+func (p *permissions) canList(prefix string) (visible, complete bool) {
+	if p == nil {
+		return true, true
+	}
+	if p.union {
+		return p.canListUnion(prefix)
+	}
+	// The access to the keys under prefix the deeper rules don't match.
+	best, base := -1, accessNone
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.exact || !strings.HasPrefix(prefix, r.prefix) {
+			continue
+		}
+		if s := r.specificity(); s > best || (s == best && r.access > base) {
+			best, base = s, r.access
+		}
+	}
+	complete = base&accessRead != 0
+	visible = complete
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !strings.HasPrefix(r.prefix, prefix) || (!r.exact && len(r.prefix) == len(prefix)) {
+			continue
+		}
+		if r.access&accessRead != 0 {
+			visible = true
+		} else {
+			complete = false
+		}
+	}
+	return visible, complete && visible
+}
+
+func (p *permissions) canListUnion(prefix string) (visible, complete bool) {
+	end := clientv3.GetPrefixRangeEnd(prefix) // "\x00" = no end
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.access&accessRead == 0 {
+			continue
+		}
+		switch {
+		case r.exact:
+			visible = visible || strings.HasPrefix(r.prefix, prefix)
+		case r.end != "":
+			if r.prefix <= prefix && (r.end == "\x00" || (end != "\x00" && r.end >= end)) {
+				visible, complete = true, true
+			} else if (end == "\x00" || r.prefix < end) && (r.end == "\x00" || r.end > prefix) {
+				visible = true
+			}
+		case strings.HasPrefix(prefix, r.prefix):
+			visible, complete = true, true
+		case strings.HasPrefix(r.prefix, prefix):
+			visible = true
+		}
+	}
+	return visible, complete
+}
+
+// permissions returns the permissions of the user making a request.
+// Users logged in with etcd credentials have their etcd permissions instead of
+// the access rules.
+func (s *apiServer) permissions(r *http.Request) *permissions {
+	u := userFromContext(r.Context())
+	if u != nil && u.etcd != nil {
+		return u.etcdPerms
+	}
+	return s.acl.forUser(u)
+}
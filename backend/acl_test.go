@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+	"github.com/stretchr/testify/require"
+)
+
+func testAccessRules(t *testing.T) *accessRules {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"roles": {
+			"team-a": ["read /config/**", "write /config/team-a/**", "deny /config/team-a/secret"],
+			"no-secrets": ["deny /secrets/**"],
+			"admin": ["write **"]
+		},
+		"users": {"alice": ["team-a"]},
+		"groups": {"ops": ["admin"]},
+		"default": ["no-secrets"]
+	}`), 0o600))
+	a, err := loadAccessRules(path)
+	require.NoError(t, err, "loadAccessRules")
+	return a
+}
+
+func TestAccessRules(t *testing.T) {
+	a := testAccessRules(t)
+	alice := a.forUser(&User{Name: "alice"})
+	for key, want := range map[string]access{
+		"/config/x":              accessRead,
+		"/config/team-a/x":       accessWrite,
+		"/config/team-a/secret":  accessDeny,
+		"/config/team-a/secret2": accessWrite,
+		"/secrets/x":             accessDeny,
+		"/other":                 accessNone,
+	} {
+		require.Equal(t, want, alice.accessTo(key), "wrong access to %s", key)
+	}
+	require.True(t, alice.canRead("/config/x"))
+	require.False(t, alice.canWrite("/config/x"))
+	require.True(t, alice.canWrite("/config/team-a/x"))
+	require.False(t, alice.canRead("/other"), "expected unmatched keys to be denied")
+
+	for prefix, want := range map[string][2]bool{
+		"/":               {true, false},  // /config/ under it
+		"/config/":        {true, false},  // the secret under it
+		"/config/team-b/": {true, true},   // all readable
+		"/secrets/":       {false, false}, // all denied
+	} {
+		visible, complete := alice.canList(prefix)
+		require.Equal(t, want, [2]bool{visible, complete}, "wrong listing of %s", prefix)
+	}
+
+	require.False(t, a.forUser(&User{Name: "alice", ruleName: "proxy:alice"}).canRead("/config/x"), "expected a proxy user to not have the roles of a local user")
+	require.False(t, a.forUser(&User{Name: "alice", ruleName: "oidc:alice"}).canRead("/config/x"), "expected an OIDC user to not have the roles of a local user")
+
+	admin := a.forUser(&User{Name: "bob", Groups: []string{"ops"}})
+	require.True(t, admin.canWrite("/config/team-a/secret"), "expected the group role")
+	require.False(t, admin.canRead("/secrets/x"), "expected a deny of the same specificity to win")
+	require.True(t, a.forUser(&User{Name: "carol", Groups: []string{"admin"}}).canWrite("/x"), "expected a group named after a role to have it")
+	require.False(t, a.forUser(nil).canRead("/x"), "expected only the default roles without a user")
+	require.True(t, (*accessRules)(nil).forUser(nil).canWrite("/x"), "expected no restrictions without rules")
+
+	for _, rule := range []string{"read", "read /a/*/b", "list /a/**"} {
+		_, err := parseAccessRule(rule)
+		require.Error(t, err, "expected %q to be invalid", rule)
+	}
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"roles": {}, "users": {"alice": ["missing"]}}`), 0o600))
+	_, err := loadAccessRules(path)
+	require.ErrorContains(t, err, "unknown role", "expected an unknown role to fail")
+}
+
+func TestAccessRulesEnforced(t *testing.T) {
+	a := testAccessRules(t)
+	alice := a.forUser(&User{Name: "alice"})
+	root := nodetree.NewNode("", 0)
+	for _, k := range []string{"/config/team-a/x", "/config/team-a/secret", "/config/team-b/y", "/secrets/z"} {
+		root.PutNode(k, nodetree.Meta{ModRevision: 5, Size: 3})
+	}
+	s := &apiServer{leases: newLeaseTracker(nil, nil, nil)}
+	st := &treeState{root: root, rev: 5}
+	names := func(res *subtreeResponse) []string {
+		var keys []string
+		for _, e := range res.Keys {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+	res := s.getSubtreeKeys(st, "", entryOrders[""], alice)
+	require.Equal(t, []string{"/config/"}, names(res), "expected the denied subtree to be hidden")
+	require.Zero(t, res.Keys[0].Count, "expected no aggregates of a partially hidden subtree")
+	res = s.getSubtreeKeys(st, "/config/team-a/", entryOrders[""], alice)
+	require.Equal(t, []string{"x"}, names(res), "expected the denied key to be hidden")
+	res = s.getSubtreeKeys(st, "/config/", entryOrders[""], alice)
+	require.Equal(t, []string{"team-a/", "team-b/"}, names(res))
+	require.Equal(t, int64(1), res.Keys[1].Count, "expected the aggregates of a fully readable subtree")
+
+	sub := subscription{perms: alice}
+	require.True(t, sub.accepts(newEvent(updateMsg{Key: strPtr("/config/team-a/x")})))
+	require.False(t, sub.accepts(newEvent(updateMsg{Key: strPtr("/secrets/z")})), "expected events of denied keys to be dropped")
+	sub.apply(&clientMsg{Key: strPtr("/config/team-a/secret")})
+	_, ok := sub.encode(newEvent(updateMsg{Key: strPtr("/config/team-a/secret")}))
+	require.False(t, ok, "expected the value of a denied key to not be sent")
+}
+
+func strPtr(s string) *string { return &s }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie      = "etcdv3-browser-session"
+	sessionSweepPeriod = time.Minute
+)
+
+// User is an authenticated browser user.
+type User struct {
+	Name      string
+	Groups    []string
+	ruleName  string           // the name in the users of the access rules, if not Name
+	etcd      *clientv3.Client // the user's own etcd client, see etcdLogin
+	etcdPerms *permissions     // the user's etcd permissions, as of the login
+	closeEtcd func()           // releases etcd at the end of the session
+}
+
+type userKey struct{}
+
+func withUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// userFromContext returns the authenticated user of a request, or nil if
+// authentication is disabled.
+func userFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
+
+// requestUser identifies the user making a request: the authenticated user,
+// or the address when authentication is disabled.
+func requestUser(r *http.Request) string {
+	if u := userFromContext(r.Context()); u != nil {
+		return u.Name
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// authenticator identifies the user of a request, if it can.
+type authenticator interface {
+	authenticate(r *http.Request) *User
+}
+
+type authConfig struct {
+	UsersFile         string // name:bcrypt-hash[:group,...] per line
+	ProxyHeader       string // e.g. X-Forwarded-User
+	ProxyGroupsHeader string // e.g. X-Forwarded-Groups, comma-separated
+	TrustedProxies    string // comma-separated CIDRs allowed to set the proxy headers
+	SessionTTL        time.Duration
+	OIDC              *oidcConfig     // nil to disable OpenID Connect login
+	EtcdLogin         passwordChecker // logs users in with their etcd credentials, instead of UsersFile
+}
+
+// auth is the authentication middleware. All the requests except the login
+// pages, health and metrics require an authenticated user.
+type auth struct {
+	authenticators []authenticator
+	passwords      passwordChecker // nil if there is no password login
+	oidc           *oidcProvider   // nil if OpenID Connect login is disabled
+	sessions       *sessionStore
+}
+
+// newAuth returns the configured authentication, or nil if none is.
+func newAuth(cfg authConfig) (*auth, error) {
+	a := &auth{sessions: newSessionStore(cfg.SessionTTL)}
+	if cfg.ProxyHeader != "" {
+		p, err := newProxyAuth(cfg.ProxyHeader, cfg.ProxyGroupsHeader, cfg.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		a.authenticators = append(a.authenticators, p)
+	}
+	if cfg.EtcdLogin != nil {
+		if cfg.UsersFile != "" {
+			return nil, errors.New("local users and etcd logins are mutually exclusive")
+		}
+		// Their requests would go through the shared etcd client.
+		if cfg.ProxyHeader != "" || cfg.OIDC != nil {
+			return nil, errors.New("proxy and OIDC users have no etcd credentials for etcd logins")
+		}
+		a.passwords = cfg.EtcdLogin
+	} else if cfg.UsersFile != "" {
+		passwords, err := loadPasswordFile(cfg.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		a.passwords = passwords
+	}
+	if cfg.OIDC != nil {
+		a.oidc = newOIDCProvider(*cfg.OIDC)
+	}
+	if len(a.authenticators) == 0 && a.passwords == nil && a.oidc == nil {
+		return nil, nil
+	}
+	a.authenticators = append(a.authenticators, a.sessions)
+	go a.sessions.sweepLoop()
+	return a, nil
+}
+
+func (a *auth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			a.handleLogin(w, r)
+			return
+		case "/logout":
+			a.handleLogout(w, r)
+			return
+		case "/oidc/login", "/oidc/callback":
+			if a.oidc != nil {
+				a.handleOIDC(w, r)
+				return
+			}
+		case "/debug/health", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, authn := range a.authenticators {
+			if u := authn.authenticate(r); u != nil {
+				next.ServeHTTP(w, r.WithContext(withUser(r.Context(), u)))
+				return
+			}
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") || r.Method != "GET" || (a.passwords == nil && a.oidc == nil) {
+			// A login page wouldn't help with only the proxy header.
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return
+		}
+		if a.passwords == nil && a.oidc != nil {
+			http.Redirect(w, r, "/oidc/login", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+}
+
+type loginModel struct {
+	Error     string
+	Passwords bool
+	OIDC      bool
+}
+
+func (a *auth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	model := loginModel{Passwords: a.passwords != nil, OIDC: a.oidc != nil}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if a.passwords == nil {
+			http.Error(w, "password login not enabled", http.StatusBadRequest)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin login", http.StatusForbidden)
+			return
+		}
+		if u := a.passwords.check(r.PostFormValue("username"), r.PostFormValue("password")); u != nil {
+			log.Printf("User %s logged in from %s", u.Name, r.RemoteAddr)
+			a.sessions.start(w, r, u)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		log.Printf("Failed login for %q from %s", r.PostFormValue("username"), r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		model.Error = "Invalid username or password"
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	renderLogin(w, &model)
+}
+
+func renderLogin(w http.ResponseWriter, model *loginModel) {
+	if err := templates.ExecuteTemplate(w, "login.gohtml", model); err != nil {
+		log.Print("ExecuteTemplate: ", err)
+	}
+}
+
+func (a *auth) handleOIDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.URL.Path == "/oidc/login" {
+		a.oidc.handleLogin(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	u, err := a.oidc.callback(r)
+	if err != nil {
+		log.Printf("Failed OIDC login from %s: %v", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		renderLogin(w, &loginModel{Error: "Login failed", Passwords: a.passwords != nil, OIDC: true})
+		return
+	}
+	log.Printf("User %s logged in with OIDC from %s", u.Name, r.RemoteAddr)
+	a.sessions.start(w, r, u)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (a *auth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin logout", http.StatusForbidden)
+		return
+	}
+	a.sessions.end(w, r)
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// passwordChecker logs users in with a password.
+type passwordChecker interface {
+	// check returns the user if the password is correct.
+	check(name, password string) *User
+}
+
+// passwordFile holds local users with bcrypt password hashes, as created by
+// htpasswd -B, optionally followed by a colon and the comma-separated groups.
+type passwordFile struct {
+	users map[string]passwordUser
+}
+
+type passwordUser struct {
+	hash   []byte
+	groups []string
+}
+
+// dummyHash is compared against for unknown users, to take the same time.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+func loadPasswordFile(path string) (*passwordFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := &passwordFile{users: map[string]passwordUser{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fields := strings.Split(s, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash[:groups]", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		u := passwordUser{hash: []byte(fields[1])}
+		if len(fields) == 3 {
+			u.groups = splitList(fields[2])
+		}
+		p.users[fields[0]] = u
+	}
+	return p, scanner.Err()
+}
+
+// check returns the user if the password is correct.
+func (p *passwordFile) check(name, password string) *User {
+	u, found := p.users[name]
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return nil
+	}
+	return &User{Name: name, Groups: u.groups}
+}
+
+// proxyAuth trusts the user set by a reverse proxy in a request header.
+type proxyAuth struct {
+	header, groupsHeader string
+	trusted              []netip.Prefix
+}
+
+func newProxyAuth(header, groupsHeader, trusted string) (*proxyAuth, error) {
+	p := &proxyAuth{header: header, groupsHeader: groupsHeader}
+	for _, s := range splitList(trusted) {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxies: %w", err)
+		}
+		p.trusted = append(p.trusted, prefix)
+	}
+	return p, nil
+}
+
+func (p *proxyAuth) authenticate(r *http.Request) *User {
+	name := r.Header.Get(p.header)
+	if name == "" || !p.isTrusted(r.RemoteAddr) {
+		return nil
+	}
+	u := &User{Name: name, ruleName: "proxy:" + name}
+	if p.groupsHeader != "" {
+		u.Groups = splitList(r.Header.Get(p.groupsHeader))
+	}
+	return u
+}
+
+func (p *proxyAuth) isTrusted(remoteAddr string) bool {
+	addr, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionStore keeps the logged in users by session cookie, in memory.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	ttl      time.Duration
+}
+
+type session struct {
+	user    *User
+	expires time.Time
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{sessions: map[string]*session{}, ttl: ttl}
+}
+
+// start creates a session for the user and sets the cookie.
+func (s *sessionStore) start(w http.ResponseWriter, r *http.Request, u *User) {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	s.mu.Lock()
+	s.removeExpired(now)
+	s.sessions[id] = &session{user: u, expires: now.Add(s.ttl)}
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(s.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// end removes the session and clears the cookie.
+func (s *sessionStore) end(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		s.mu.Lock()
+		s.remove(c.Value)
+		s.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+func (s *sessionStore) authenticate(r *http.Request) *User {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, found := s.sessions[c.Value]
+	if !found {
+		return nil
+	}
+	if time.Now().After(sess.expires) {
+		s.remove(c.Value)
+		return nil
+	}
+	return sess.user
+}
+
+// sweepLoop removes the expired sessions of the users who didn't come back,
+// so that their etcd clients don't stay open.
+func (s *sessionStore) sweepLoop() {
+	ticker := time.NewTicker(sessionSweepPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.mu.Lock()
+		s.removeExpired(now)
+		s.mu.Unlock()
+	}
+}
+
+// removeExpired removes the sessions expired at now. Must be called with the
+// lock held.
+func (s *sessionStore) removeExpired(now time.Time) {
+	for id, sess := range s.sessions {
+		if now.After(sess.expires) {
+			s.remove(id)
+		}
+	}
+}
+
+// remove deletes a session, releasing the user's etcd client. Must be called
+// with the lock held.
+func (s *sessionStore) remove(id string) {
+	if sess, found := s.sessions[id]; found {
+		delete(s.sessions, id)
+		if sess.user.closeEtcd != nil {
+			go sess.user.closeEtcd()
+		}
+	}
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	usersFile := filepath.Join(t.TempDir(), "users")
+	require.NoError(t, os.WriteFile(usersFile, fmt.Appendf(nil, "# comment\nalice:%s:dev, ops\n", hash), 0o600))
+
+	a, err := newAuth(authConfig{
+		UsersFile:      usersFile,
+		ProxyHeader:    "X-Forwarded-User",
+		TrustedProxies: "10.0.0.0/8",
+		SessionTTL:     time.Hour,
+	})
+	require.NoError(t, err, "newAuth")
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := userFromContext(r.Context()); u != nil {
+			fmt.Fprint(w, u.Name, u.Groups)
+		}
+	}))
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(httptest.NewRequest("GET", "/api/list", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code, "expected the API to require a user")
+	w = do(httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusFound, w.Code, "expected pages to redirect to the login")
+	require.Equal(t, "/login", w.Header().Get("Location"))
+
+	login := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"username": {"alice"}, "password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return do(r)
+	}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"username": {"alice"}, "password": {"secret"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://evil.example")
+	require.Equal(t, http.StatusForbidden, do(r).Code, "expected a cross-origin login to be rejected")
+	w = login("wrong")
+	require.Equal(t, http.StatusUnauthorized, w.Code, "expected a wrong password to fail")
+	require.Empty(t, w.Result().Cookies())
+	w = login("secret")
+	require.Equal(t, http.StatusFound, w.Code, "expected a successful login")
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	r = httptest.NewRequest("GET", "/api/kvws", nil)
+	r.AddCookie(cookies[0])
+	w = do(r)
+	require.Equal(t, "alice[dev ops]", w.Body.String(), "expected the session user")
+
+	r = httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(cookies[0])
+	require.Equal(t, http.StatusFound, do(r).Code)
+	r = httptest.NewRequest("GET", "/api/kvws", nil)
+	r.AddCookie(cookies[0])
+	require.Equal(t, http.StatusUnauthorized, do(r).Code, "expected the session to end on logout")
+
+	r = httptest.NewRequest("GET", "/api/list", nil)
+	r.Header.Set("X-Forwarded-User", "bob")
+	require.Equal(t, http.StatusUnauthorized, do(r).Code, "expected the proxy header from an untrusted address to be ignored")
+	r.RemoteAddr = "10.1.2.3:4567"
+	w = do(r)
+	require.Equal(t, "bob[]", w.Body.String(), "expected the proxy user")
+
+	w = do(httptest.NewRequest("GET", "/debug/health", nil))
+	require.Equal(t, http.StatusOK, w.Code, "expected health to not require a user")
+
+	a, err = newAuth(authConfig{ProxyHeader: "X-Forwarded-User"})
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	a.handler(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code, "expected no login page with only the proxy header")
+
+	a, err = newAuth(authConfig{})
+	require.NoError(t, err)
+	require.Nil(t, a, "expected no authentication by default")
+
+	for _, cfg := range []authConfig{
+		{EtcdLogin: &etcdLogin{}, ProxyHeader: "X-Forwarded-User"},
+		{EtcdLogin: &etcdLogin{}, OIDC: &oidcConfig{}},
+	} {
+		_, err = newAuth(cfg)
+		require.Error(t, err, "expected only etcd logins with ETCD_USER_AUTH")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := newSessionStore(time.Hour)
+	closed := make(chan struct{})
+	w := httptest.NewRecorder()
+	s.start(w, httptest.NewRequest("POST", "/login", nil), &User{Name: "alice", closeEtcd: func() { close(closed) }})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	require.NotNil(t, s.authenticate(r), "expected the session")
+
+	s.mu.Lock()
+	s.removeExpired(time.Now().Add(2 * time.Hour))
+	s.mu.Unlock()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the etcd client of an expired session to be released")
+	}
+	require.Nil(t, s.authenticate(r), "expected the session to be removed")
+}
@@ -1,84 +1,169 @@
 package main
 
-import "log"
+import (
+	"log"
+	"sync/atomic"
+)
 
-// Broker is a helper class to distribute updates to connected clients.
-type Broker struct {
-	stopCh    chan struct{}
-	resetCh   chan struct{}
-	publishCh chan any
-	subCh     chan chan any
-	unsubCh   chan chan any
+// Broker is a helper class to distribute messages to connected clients.
+type Broker[T any] struct {
+	stopCh     chan chan int
+	stopped    chan struct{} // closed once the broker has stopped
+	resetCh    chan chan int
+	publishCh  chan T
+	subCh      chan *Subscription[T]
+	unsubCh    chan *Subscription[T]
+	bufferSize int
+	dropped    atomic.Int64
 }
 
-// NewBroker is self-explanatory.
-func NewBroker() *Broker {
-	return &Broker{
-		stopCh:    make(chan struct{}),
-		resetCh:   make(chan struct{}),
-		publishCh: make(chan any, 64),
-		subCh:     make(chan chan any),
-		unsubCh:   make(chan chan any),
+// Subscription is the receiving end of a broker subscriber.
+type Subscription[T any] struct {
+	C          chan T
+	filter     func(T) bool
+	overflowed atomic.Bool
+}
+
+// Overflowed tells whether the subscription was closed because the receiver
+// didn't keep up, i.e. some messages were not delivered to it.
+func (s *Subscription[T]) Overflowed() bool {
+	return s.overflowed.Load()
+}
+
+// Hold receives the messages of the subscription in the background, up to
+// limit of them, for a receiver that is busy with something else, e.g. a
+// replay. The returned function stops receiving and returns the messages held.
+// Beyond limit the messages queue up in C as usual, which may overflow.
+func (s *Subscription[T]) Hold(limit int) (release func() []T) {
+	var held []T
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(held) < limit {
+			select {
+			case <-stop:
+				return
+			case msg, ok := <-s.C:
+				if !ok {
+					return
+				}
+				held = append(held, msg)
+			}
+		}
+	}()
+	return func() []T {
+		close(stop)
+		<-done
+		return held
+	}
+}
+
+// NewBroker creates a broker, bufferSize is the default subscriber buffer size.
+func NewBroker[T any](bufferSize int) *Broker[T] {
+	return &Broker[T]{
+		stopCh:     make(chan chan int),
+		stopped:    make(chan struct{}),
+		resetCh:    make(chan chan int),
+		publishCh:  make(chan T, 64),
+		subCh:      make(chan *Subscription[T]),
+		unsubCh:    make(chan *Subscription[T]),
+		bufferSize: bufferSize,
 	}
 }
 
 // Start is self-explanatory.
-func (b *Broker) Start() {
-	subs := map[chan any]struct{}{}
+func (b *Broker[T]) Start() {
+	subs := map[*Subscription[T]]struct{}{}
+	closeAll := func() int {
+		for sub := range subs {
+			close(sub.C)
+		}
+		n := len(subs)
+		subs = map[*Subscription[T]]struct{}{}
+		return n
+	}
 	for {
 		select {
-		case <-b.stopCh:
-			for msgCh := range subs {
-				close(msgCh)
-			}
+		case done := <-b.stopCh:
+			done <- closeAll()
+			close(b.stopped)
 			return
-		case <-b.resetCh:
-			for msgCh := range subs {
-				close(msgCh)
-			}
-			subs = map[chan any]struct{}{}
-		case msgCh := <-b.subCh:
-			subs[msgCh] = struct{}{}
-		case msgCh := <-b.unsubCh:
-			delete(subs, msgCh)
+		case done := <-b.resetCh:
+			done <- closeAll()
+		case sub := <-b.subCh:
+			subs[sub] = struct{}{}
+		case sub := <-b.unsubCh:
+			delete(subs, sub)
 		case msg := <-b.publishCh:
-			for msgCh := range subs {
-				// msgCh is buffered, use non-blocking send to protect the broker:
+			for sub := range subs {
+				if sub.filter != nil && !sub.filter(msg) {
+					continue
+				}
+				// sub.C is buffered, use non-blocking send to protect the broker:
 				select {
-				case msgCh <- msg:
+				case sub.C <- msg:
 				default:
-					log.Print("Client is stuck - message ignored")
+					// Once a message is lost the receiver is out of sync,
+					// let it know by closing the channel.
+					log.Print("Client is stuck - disconnecting")
+					b.dropped.Add(1)
+					sub.overflowed.Store(true)
+					close(sub.C)
+					delete(subs, sub)
 				}
 			}
 		}
 	}
 }
 
-// Stop stops the broker.
-func (b *Broker) Stop() {
-	close(b.stopCh)
+// Close stops the broker, closing all subscriber channels.
+// Returns the number of subscribers disconnected, 0 if already stopped.
+func (b *Broker[T]) Close() int {
+	return b.request(b.stopCh)
 }
 
 // Reset closes all subscriber channels (disconnecting clients) but keeps the
-// broker running.
-func (b *Broker) Reset() {
-	b.resetCh <- struct{}{}
+// broker running. Returns the number of subscribers disconnected, 0 if the
+// broker is stopped.
+func (b *Broker[T]) Reset() int {
+	return b.request(b.resetCh)
+}
+
+func (b *Broker[T]) request(ch chan chan int) int {
+	done := make(chan int, 1)
+	select {
+	case ch <- done:
+		return <-done
+	case <-b.stopped:
+		return 0
+	}
 }
 
-// Subscribe returns a new channel for a receiver.
-func (b *Broker) Subscribe() chan any {
-	msgCh := make(chan any, 64)
-	b.subCh <- msgCh
-	return msgCh
+// Subscribe returns a new subscription for a receiver. Only messages for which
+// filter returns true are delivered, all if filter is nil. The filter is
+// called from the broker goroutine and must be fast. bufferSize 0 means the
+// broker default.
+func (b *Broker[T]) Subscribe(bufferSize int, filter func(T) bool) *Subscription[T] {
+	if bufferSize <= 0 {
+		bufferSize = b.bufferSize
+	}
+	sub := &Subscription[T]{C: make(chan T, bufferSize), filter: filter}
+	b.subCh <- sub
+	return sub
 }
 
 // Unsubscribe unbinds a receiver. The broker owns channel lifetime; do not
-// close msgCh after this.
-func (b *Broker) Unsubscribe(msgCh chan any) {
-	b.unsubCh <- msgCh
+// close sub.C after this.
+func (b *Broker[T]) Unsubscribe(sub *Subscription[T]) {
+	b.unsubCh <- sub
 }
 
 // Publish publishes a new message to all subscribers.
-func (b *Broker) Publish(msg any) {
+func (b *Broker[T]) Publish(msg T) {
 	b.publishCh <- msg
 }
+
+// Dropped returns the number of messages not delivered to slow receivers.
+func (b *Broker[T]) Dropped() int64 {
+	return b.dropped.Load()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerOverflow(t *testing.T) {
+	b := NewBroker[int](4)
+	go b.Start()
+	defer b.Close()
+	slow := b.Subscribe(0, nil)
+	fast := b.Subscribe(0, nil)
+	defer b.Unsubscribe(fast)
+
+	n := cap(slow.C) + 1
+	for i := range n {
+		b.Publish(i)
+		require.Equal(t, i, <-fast.C, "fast subscriber expected to receive every message")
+	}
+	for range cap(slow.C) {
+		<-slow.C
+	}
+	_, ok := <-slow.C
+	require.False(t, ok, "slow subscriber expected to be closed")
+	require.True(t, slow.Overflowed(), "slow subscriber expected to be overflowed")
+	require.False(t, fast.Overflowed(), "fast subscriber expected to not be overflowed")
+	require.Equal(t, int64(1), b.Dropped(), "wrong dropped count")
+}
+
+func TestBrokerFilter(t *testing.T) {
+	b := NewBroker[int](4)
+	go b.Start()
+	even := b.Subscribe(2, func(i int) bool { return i%2 == 0 })
+	all := b.Subscribe(10, nil)
+	require.Equal(t, 2, cap(even.C), "wrong buffer size")
+	for i := range 4 {
+		b.Publish(i)
+		require.Equal(t, i, <-all.C, "expected to receive every message")
+	}
+	require.Equal(t, 0, <-even.C, "expected to receive 0")
+	require.Equal(t, 2, <-even.C, "expected to receive 2")
+	require.False(t, even.Overflowed(), "filtered messages expected to not count")
+
+	require.Equal(t, 2, b.Reset(), "expected 2 subscribers to be disconnected")
+	_, ok := <-all.C
+	require.False(t, ok, "subscriber expected to be closed")
+	b.Subscribe(0, nil)
+	require.Equal(t, 1, b.Close(), "expected 1 subscriber to be disconnected")
+	require.Zero(t, b.Close(), "expected a second Close to return")
+	require.Zero(t, b.Reset(), "expected Reset after Close to return")
+}
+
+func TestSubscriptionHold(t *testing.T) {
+	b := NewBroker[int](10)
+	go b.Start()
+	defer b.Close()
+	sub := b.Subscribe(0, nil)
+	release := sub.Hold(5)
+	for i := range 6 {
+		b.Publish(i)
+	}
+	require.Eventually(t, func() bool { return len(sub.C) == 1 }, time.Second, time.Millisecond, "expected the messages beyond the limit to queue up")
+	require.Equal(t, []int{0, 1, 2, 3, 4}, release(), "expected the messages to be held")
+	require.Equal(t, 5, <-sub.C)
+	require.False(t, sub.Overflowed(), "expected no overflow within the buffer")
+}
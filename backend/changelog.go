@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	changeLogFile      = "changes.jsonl"
+	changeLogIndexStep = 1024 // records between index entries
+	actorLookahead     = 1000 // records scanned past a page for late user records
+)
+
+// changeRecord is a line in the change log. A record without a key carries the
+// user that made the change at Rev, written when the change was made through
+// the browser, or with Gap, tells that the changes after revision Gap up to Rev
+// may be missing.
+type changeRecord struct {
+	updateMsg
+	Time time.Time `json:"time,omitzero"`
+	User string    `json:"user,omitempty"`
+	Gap  int64     `json:"gap,omitempty"`
+}
+
+// changeGap is a revision range the change log may be missing changes of: the
+// watch was lost after revision After and resumed after revision Rev.
+type changeGap struct {
+	After int64 `json:"after"`
+	Rev   int64 `json:"rev"`
+}
+
+type changeLogIndex struct {
+	rev    int64
+	offset int64
+}
+
+// changeLog is an append-only file of all the updates seen by the watch, kept
+// beyond etcd compaction. It grows without bounds. The file is read by offset,
+// it must not be moved or truncated while the server runs, only once stopped.
+// It has all the values, readable only by the owner.
+type changeLog struct {
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	count    int
+	index    []changeLogIndex // sparse, by offset
+	firstRev int64
+	lastRev  int64
+	skipRev  int64 // revisions recorded before a restart
+	gaps     []changeGap
+}
+
+// openChangeLog opens or creates the change log in dir. A partially written
+// last line is truncated.
+func openChangeLog(dir string) (*changeLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, changeLogFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chmod(0o600); err != nil { // of an older version
+		f.Close()
+		return nil, err
+	}
+	l := &changeLog{f: f}
+	if err = l.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.skipRev = l.lastRev
+	return l, nil
+}
+
+func (l *changeLog) scan() error {
+	r := bufio.NewReader(l.f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Drop a line cut short by a crash.
+			if err = l.f.Truncate(l.size); err == nil {
+				_, err = l.f.Seek(l.size, io.SeekStart)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		var rec changeRecord
+		if json.Unmarshal(line, &rec) == nil {
+			if rec.Key != nil {
+				l.indexRecord(rec.Rev)
+			} else if rec.Gap != 0 {
+				l.gaps = append(l.gaps, changeGap{rec.Gap, rec.Rev})
+			}
+		}
+		l.size += int64(len(line))
+	}
+}
+
+// indexRecord accounts for a change record about to be written at l.size.
+func (l *changeLog) indexRecord(rev int64) {
+	if l.count%changeLogIndexStep == 0 {
+		l.index = append(l.index, changeLogIndex{rev, l.size})
+	}
+	if l.firstRev == 0 {
+		l.firstRev = rev
+	}
+	l.lastRev = max(l.lastRev, rev)
+	l.count++
+}
+
+func (l *changeLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// restart records a gap when the watch resumes after revision rev, having
+// seen the changes up to revision after, 0 for the last change recorded.
+func (l *changeLog) restart(after, rev int64, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if after == 0 {
+		after = l.lastRev
+	}
+	if after == 0 || after >= rev {
+		return nil // an empty log misses nothing, it starts at its first record
+	}
+	b, err := json.Marshal(&changeRecord{updateMsg: updateMsg{Rev: rev}, Time: now, Gap: after})
+	if err != nil {
+		return err
+	}
+	l.gaps = append(l.gaps, changeGap{after, rev})
+	l.size += int64(len(b)) + 1
+	return l.write(append(b, '\n'))
+}
+
+// gapsIn returns the gaps overlapping revisions from to to, inclusive.
+func (l *changeLog) gapsIn(from, to int64) []changeGap {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var res []changeGap
+	for _, g := range l.gaps {
+		if g.After < to && g.Rev >= from {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// record appends the updates from a watch response.
+func (l *changeLog) record(msgs []updateMsg, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if msg.Rev <= l.skipRev {
+			continue
+		}
+		b, err := json.Marshal(&changeRecord{updateMsg: msg, Time: now})
+		if err != nil {
+			return err
+		}
+		l.indexRecord(msg.Rev)
+		l.size += int64(len(b)) + 1
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return l.write(buf.Bytes())
+}
+
+// recordUser appends the user that made the change at rev.
+func (l *changeLog) recordUser(rev int64, user string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, err := json.Marshal(&changeRecord{updateMsg: updateMsg{Rev: rev}, User: user})
+	if err != nil {
+		return err
+	}
+	l.size += int64(len(b)) + 1
+	return l.write(append(b, '\n'))
+}
+
+func (l *changeLog) write(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := l.f.Write(b)
+	return err
+}
+
+// query returns up to limit changes under prefix between revisions from and
+// to, inclusive, not splitting a revision, and the revision to continue from.
+// Only the changes of the keys visible returns true for count, nil = all keys.
+func (l *changeLog) query(prefix string, from, to int64, limit int, visible func(key string) bool) ([]changeRecord, int64, error) {
+	l.mu.Lock()
+	offset, size := int64(0), l.size
+	if i := sort.Search(len(l.index), func(i int) bool { return l.index[i].rev >= from }); i > 0 {
+		offset = l.index[i-1].offset
+	}
+	l.mu.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(l.f, offset, size-offset))
+	res := []changeRecord{}
+	users := map[int64]string{}
+	var next int64
+	for lookahead := 0; lookahead < actorLookahead; {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		var rec changeRecord
+		if json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+		switch {
+		case rec.Key == nil:
+			if rec.Gap == 0 {
+				users[rec.Rev] = rec.User
+			}
+		case next != 0 || rec.Rev > to:
+			lookahead++
+		case rec.Rev < from || !strings.HasPrefix(*rec.Key, prefix):
+		case visible != nil && !visible(*rec.Key):
+		case len(res) >= limit && rec.Rev != res[len(res)-1].Rev:
+			next = rec.Rev
+		default:
+			res = append(res, rec)
+		}
+	}
+	for i := range res {
+		res[i].User = users[res[i].Rev]
+	}
+	return res, next, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openChangeLog(dir)
+	require.NoError(t, err, "openChangeLog")
+	now := time.Now()
+	msg := func(key string, rev int64) updateMsg {
+		value := fmt.Sprint("v", rev)
+		return updateMsg{Key: &key, Value: &value, Rev: rev}
+	}
+	revs := func(events []changeRecord) []int64 {
+		res := []int64{}
+		for _, ev := range events {
+			res = append(res, ev.Rev)
+		}
+		return res
+	}
+	for rev := int64(1); rev <= 2000; rev++ {
+		require.NoError(t, l.record([]updateMsg{msg("a/1", rev), msg("b/1", rev)}, now), "record")
+	}
+	require.NoError(t, l.recordUser(1500, "alice"), "recordUser")
+
+	events, next, err := l.query("a/", 1499, 1501, 10, nil)
+	require.NoError(t, err, "query")
+	require.Equal(t, []int64{1499, 1500, 1501}, revs(events), "wrong range")
+	require.Zero(t, next, "expected no next page")
+	require.Equal(t, "alice", events[1].User, "expected the user of a later record")
+	require.Equal(t, "v1500", events[1].Value, "expected the value")
+	require.WithinDuration(t, now, events[1].Time, time.Second, "expected the time")
+
+	events, next, err = l.query("", 10, 20, 3, nil)
+	require.NoError(t, err, "query")
+	require.Equal(t, []int64{10, 10, 11, 11}, revs(events), "a page shouldn't split a revision")
+	require.Equal(t, int64(12), next, "wrong next page")
+	require.NoError(t, l.Close())
+
+	// A partial last line is dropped and revisions recorded before are skipped.
+	f, err := os.OpenFile(filepath.Join(dir, changeLogFile), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"key":"a/1","rev":20`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	l, err = openChangeLog(dir)
+	require.NoError(t, err, "reopen")
+	require.NoError(t, l.record([]updateMsg{msg("a/1", 2000), msg("a/1", 2001)}, now), "record")
+	events, _, err = l.query("a/", 1999, 3000, 10, nil)
+	require.NoError(t, err, "query")
+	require.Equal(t, []int64{1999, 2000, 2001}, revs(events), "expected no duplicates after reopen")
+
+	// A restart of the watch past the last change is a gap.
+	require.NoError(t, l.restart(0, 2001, now), "restart")
+	require.Empty(t, l.gaps, "expected no gap when nothing was missed")
+	require.NoError(t, l.restart(0, 2010, now), "restart")
+	require.NoError(t, l.restart(2015, 2020, now), "restart")
+	require.NoError(t, l.record([]updateMsg{msg("a/1", 2021)}, now), "record")
+	require.Equal(t, []changeGap{{2001, 2010}}, l.gapsIn(1, 2010), "wrong gaps")
+	require.Empty(t, l.gapsIn(2011, 2015), "expected no gaps between them")
+	require.NoError(t, l.Close())
+	l, err = openChangeLog(dir)
+	require.NoError(t, err, "reopen")
+	defer l.Close()
+	require.Equal(t, []changeGap{{2001, 2010}, {2015, 2020}}, l.gaps, "expected the gaps after reopen")
+	events, _, err = l.query("a/", 2001, 3000, 10, nil)
+	require.NoError(t, err, "query")
+	require.Equal(t, []int64{2001, 2021}, revs(events), "expected the gaps to not be changes")
+	require.Empty(t, events[1].User, "expected a gap to not be a user")
+}
@@ -0,0 +1,42 @@
+package main
+
+// maxCoalesceWindow caps the coalescing window a client can ask for.
+const maxCoalesceWindow = 10000 // ms
+
+// coalescer holds back key updates, keeping only the latest one per key.
+type coalescer struct {
+	index  map[string]int // key -> position in events
+	events []*event       // in order of arrival, nil if superseded
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{index: make(map[string]int)}
+}
+
+// add queues an update, replacing the pending one for the same key.
+func (c *coalescer) add(key string, ev *event) {
+	c.remove(key)
+	c.index[key] = len(c.events)
+	c.events = append(c.events, ev)
+}
+
+// remove drops the pending update for key, if any.
+func (c *coalescer) remove(key string) {
+	if i, found := c.index[key]; found {
+		c.events[i] = nil
+		delete(c.index, key)
+	}
+}
+
+// flush returns the pending updates in order and clears the queue.
+func (c *coalescer) flush() []*event {
+	res := make([]*event, 0, len(c.index))
+	for _, ev := range c.events {
+		if ev != nil {
+			res = append(res, ev)
+		}
+	}
+	clear(c.index)
+	c.events = c.events[:0]
+	return res
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer()
+	a1, b2, a3, c4 := newEvent(1), newEvent(2), newEvent(3), newEvent(4)
+	c.add("a", a1)
+	c.add("b", b2)
+	c.add("a", a3)
+	c.add("c", c4)
+	c.remove("c")
+	require.Equal(t, []*event{b2, a3}, c.flush(), "expected the latest update per key, in order")
+	require.Empty(t, c.flush(), "expected nothing after a flush")
+	c.add("a", a1)
+	require.Equal(t, []*event{a1}, c.flush(), "expected to work after a flush")
+}
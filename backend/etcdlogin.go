@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const etcdLoginMaxClients = 100 // etcd clients of logged in users
+
+// etcdLogin logs users in with their own etcd credentials. The sessions get
+// an etcd client of the user, so that etcd enforces the user's permissions on
+// reads and writes, shared by the sessions with the same credentials and
+// closed at the end of the last one. The shared tree is
+// filtered by the user's etcd permissions, fetched at login; changes to them
+// apply from the next login.
+type etcdLogin struct {
+	cfg clientv3.Config // the shared client's configuration
+
+	mu      sync.Mutex
+	clients map[[sha256.Size]byte]*etcdUserClient // by the hash of the credentials
+}
+
+type etcdUserClient struct {
+	*clientv3.Client
+	sessions int
+}
+
+func newEtcdLogin(cfg clientv3.Config) *etcdLogin {
+	return &etcdLogin{cfg: cfg, clients: map[[sha256.Size]byte]*etcdUserClient{}}
+}
+
+func (l *etcdLogin) check(name, password string) *User {
+	if name == "" || password == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	client, err := l.acquire(ctx, key, name, password)
+	if err != nil {
+		log.Printf("etcdLogin %s: %v", name, err)
+		return nil
+	}
+	perms, err := etcdUserPermissions(ctx, client.Client, name)
+	if err != nil {
+		log.Printf("etcdLogin %s: %v", name, err)
+		l.release(key, client)
+		return nil
+	}
+	return &User{Name: name, etcd: client.Client, etcdPerms: perms, closeEtcd: func() { l.release(key, client) }}
+}
+
+// acquire returns the etcd client for the credentials, creating it if there is
+// none, which checks them.
+func (l *etcdLogin) acquire(ctx context.Context, key [sha256.Size]byte, name, password string) (*etcdUserClient, error) {
+	l.mu.Lock()
+	c := l.clients[key]
+	if c != nil {
+		c.sessions++
+		l.mu.Unlock()
+		// The password may have changed since the client was created.
+		if _, err := c.Authenticate(ctx, name, password); err != nil {
+			l.release(key, c)
+			return nil, err
+		}
+		return c, nil
+	}
+	full := len(l.clients) >= etcdLoginMaxClients
+	l.mu.Unlock()
+	if full {
+		return nil, errors.New("too many etcd clients")
+	}
+	cfg := l.cfg
+	cfg.Username, cfg.Password = name, password
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c = l.clients[key]; c != nil {
+		go client.Close() // of a concurrent login
+	} else {
+		c = &etcdUserClient{Client: client}
+		l.clients[key] = c
+	}
+	c.sessions++
+	return c, nil
+}
+
+// release closes the client at the end of its last session.
+func (l *etcdLogin) release(key [sha256.Size]byte, c *etcdUserClient) {
+	l.mu.Lock()
+	c.sessions--
+	last := c.sessions == 0
+	if last {
+		delete(l.clients, key)
+	}
+	l.mu.Unlock()
+	if last {
+		c.Close()
+	}
+}
+
+// etcdUserPermissions reads the user's own roles and their permissions, which
+// also checks the credentials. The root role has access to everything.
+func etcdUserPermissions(ctx context.Context, client *clientv3.Client, name string) (*permissions, error) {
+	user, err := client.UserGet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(user.Roles, "root") {
+		return nil, nil
+	}
+	var perms []*authpb.Permission
+	for _, role := range user.Roles {
+		res, err := client.RoleGet(ctx, role)
+		if err != nil {
+			return nil, err
+		}
+		perms = append(perms, res.Perm...)
+	}
+	return etcdPermissions(perms), nil
+}
+
+// etcdPermissions converts etcd permissions to access rules.
+func etcdPermissions(perms []*authpb.Permission) *permissions {
+	p := &permissions{union: true}
+	for _, perm := range perms {
+		r := accessRule{prefix: string(perm.Key), access: accessRead}
+		switch perm.PermType {
+		case authpb.Permission_WRITE:
+			r.access = accessWriteOnly
+		case authpb.Permission_READWRITE:
+			r.access = accessWrite
+		}
+		switch end := string(perm.RangeEnd); {
+		case end == "":
+			r.exact = true
+		case end == "\x00" && r.prefix == "\x00":
+			r.prefix = "" // all keys
+		case end == clientv3.GetPrefixRangeEnd(r.prefix):
+		default:
+			r.end = end
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p
+}
+
+// etcdFor returns the etcd client to use for a request: the user's own, if
+// logged in with etcd credentials.
+func (s *apiServer) etcdFor(r *http.Request) *clientv3.Client {
+	if u := userFromContext(r.Context()); u != nil && u.etcd != nil {
+		return u.etcd
+	}
+	return s.etcd
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/authpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdPermissions(t *testing.T) {
+	perm := func(typ authpb.Permission_Type, key, end string) *authpb.Permission {
+		return &authpb.Permission{PermType: typ, Key: []byte(key), RangeEnd: []byte(end)}
+	}
+	p := etcdPermissions([]*authpb.Permission{
+		perm(authpb.Permission_READ, "/config/", clientv3.GetPrefixRangeEnd("/config/")),
+		perm(authpb.Permission_WRITE, "/config/team-a/", clientv3.GetPrefixRangeEnd("/config/team-a/")),
+		perm(authpb.Permission_READWRITE, "/single", ""),
+		perm(authpb.Permission_READ, "/logs/2024", "/logs/2025"),
+		perm(authpb.Permission_WRITE, "/inbox/", clientv3.GetPrefixRangeEnd("/inbox/")),
+	})
+	require.True(t, p.canRead("/config/x"))
+	require.False(t, p.canWrite("/config/x"))
+	require.True(t, p.canWrite("/config/team-a/x"), "expected the permissions to add up")
+	require.True(t, p.canRead("/config/team-a/x"), "expected a less specific read to still apply")
+	require.True(t, p.canWrite("/single"))
+	require.False(t, p.canRead("/single/x"), "expected a single key permission")
+	require.True(t, p.canRead("/logs/2024-05"), "expected a key in the range")
+	require.False(t, p.canRead("/logs/2025"), "expected the range end to be excluded")
+	require.True(t, p.canWrite("/inbox/x"))
+	require.False(t, p.canRead("/inbox/x"), "expected a write-only permission")
+
+	for prefix, want := range map[string][2]bool{
+		"":             {true, false},
+		"/config/":     {true, true},
+		"/logs/":       {true, false},
+		"/logs/2024/":  {true, true},
+		"/logs/2026/":  {false, false},
+		"/inbox/":      {false, false},
+		"/other/":      {false, false},
+		"/config/sub/": {true, true},
+	} {
+		visible, complete := p.canList(prefix)
+		require.Equal(t, want, [2]bool{visible, complete}, "wrong listing of %q", prefix)
+	}
+
+	all := etcdPermissions([]*authpb.Permission{perm(authpb.Permission_READ, "\x00", "\x00")})
+	require.True(t, all.canRead("/anything"), "expected a permission on all keys")
+	visible, complete := all.canList("")
+	require.True(t, visible && complete)
+
+	s := &apiServer{acl: &accessRules{}}
+	r := httptest.NewRequest("GET", "/api/list", nil)
+	r = r.WithContext(withUser(r.Context(), &User{Name: "alice", etcd: &clientv3.Client{}, etcdPerms: p}))
+	require.Same(t, p, s.permissions(r), "expected the etcd permissions of an etcd user")
+}
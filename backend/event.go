@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// event is a message published to the broker. It is JSON-encoded at most once
+// in each form (with and without the value), and the encoded bytes are shared
+// by all receivers. Must not be modified after publishing.
+type event struct {
+	msg          any // updateMsg, leaseMsg, ...
+	withValue    lazyJSON
+	withoutValue lazyJSON
+}
+
+type lazyJSON struct {
+	once sync.Once
+	data []byte
+}
+
+func newEvent(msg any) *event {
+	return &event{msg: msg}
+}
+
+// encoded returns the JSON encoding of the message, with or without the value.
+func (e *event) encoded(value bool) []byte {
+	msg, ok := e.msg.(updateMsg)
+	if !ok || value || msg.Value == nil && msg.PrevValue == nil {
+		return e.withValue.get(e.msg)
+	}
+	msg.Value, msg.PrevValue, msg.PrevRev = nil, nil, 0
+	return e.withoutValue.get(msg)
+}
+
+func (j *lazyJSON) get(msg any) []byte {
+	j.once.Do(func() {
+		var err error
+		if j.data, err = json.Marshal(msg); err != nil {
+			log.Print("json.Marshal: ", err)
+		}
+	})
+	return j.data
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventEncoded(t *testing.T) {
+	key, value := "a", "v"
+	ev := newEvent(updateMsg{Key: &key, Value: &value, Rev: 3})
+	require.Equal(t, `{"key":"a","value":"v","rev":3}`, string(ev.encoded(true)))
+	require.Equal(t, `{"key":"a","rev":3}`, string(ev.encoded(false)))
+	require.Equal(t, &ev.encoded(false)[0], &ev.encoded(false)[0], "expected to be encoded once")
+	prev := "p"
+	ev = newEvent(updateMsg{Key: &key, Deleted: 1, Rev: 4, PrevValue: &prev, PrevRev: 3})
+	require.Equal(t, `{"key":"a","deleted":1,"rev":4,"prevvalue":"p","prevrev":3}`, string(ev.encoded(true)))
+	require.Equal(t, `{"key":"a","deleted":1,"rev":4}`, string(ev.encoded(false)))
+	ev = newEvent(leaseMsg{Lease: 1, Event: "expired"})
+	require.Equal(t, `{"lease":1,"event":"expired","ttl":0,"grantedttl":0}`, string(ev.encoded(false)))
+}
+
+// BenchmarkFanout compares encoding an event per subscriber with encoding it
+// once for all subscribers.
+func BenchmarkFanout(b *testing.B) {
+	key, value := "/config/service/feature-flags", strings.Repeat("x", 1024)
+	msg := updateMsg{Key: &key, Value: &value, Rev: 12345, Version: 7, Size: int64(len(value))}
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("per-subscriber/%d", n), func(b *testing.B) {
+			for b.Loop() {
+				for i := range n {
+					m := msg
+					if i != 0 {
+						m.Value = nil
+					}
+					if _, err := json.Marshal(m); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("shared/%d", n), func(b *testing.B) {
+			for b.Loop() {
+				ev := newEvent(msg)
+				for i := range n {
+					if ev.encoded(i == 0) == nil {
+						b.Fatal("not encoded")
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleEvents streams the same messages as the websocket as Server-Sent Events,
+// for clients that can't use websockets. Query parameters:
+// prefix (repeatable) - key prefixes to receive events for, all keys by default;
+// k, pin (repeatable) - keys to receive values of.
+// The event id is the revision, a reconnecting client resumes after Last-Event-ID.
+func (s *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.snapshot().etcdReady {
+		http.Error(w, "etcd not connected", http.StatusServiceUnavailable)
+		return
+	}
+	_ = r.ParseForm()
+	key := r.Form.Get("k")
+	sub := subscription{perms: s.permissions(r)}
+	sub.apply(&clientMsg{Key: &key, Subscribe: r.Form["prefix"], Pin: r.Form["pin"]})
+	var lastRev int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		lastRev, _ = strconv.ParseInt(id, 10, 64)
+	}
+
+	input := s.broker.Subscribe(0, sub.accepts)
+	defer func() { s.broker.Unsubscribe(input) }()
+	rev := s.snapshot().rev
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable proxy buffering in nginx
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		log.Print("SSE Flush: ", err)
+		return
+	}
+
+	var held []*event
+	if lastRev > 0 && lastRev < rev {
+		// The live events are held back meanwhile, and sent after.
+		release := input.Hold(replayHoldLimit)
+		replay := func(msg updateMsg) error {
+			data, ok := sub.encode(newEvent(msg))
+			if !ok {
+				return nil
+			}
+			return writeEvent(rc, w, msg, data)
+		}
+		var err error
+		if recent, ok := s.recent.after(lastRev); ok {
+			// from memory, without values
+			for _, ev := range recent {
+				if ev.Rev > rev || err != nil {
+					break
+				}
+				err = replay(ev.updateMsg)
+			}
+		} else {
+			err = s.replayEvents(r.Context(), s.prefix, lastRev+1, rev, replay)
+		}
+		held = release()
+		if _, compacted := err.(*compactedError); compacted {
+			// The client has to reload the tree.
+			err = writeEvent(rc, w, resyncMsg{Resync: true, Rev: rev}, nil)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Print("SSE replay: ", err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	send := func(next *event) error {
+		if msg, ok := next.msg.(updateMsg); ok && msg.Rev <= rev {
+			return nil // already replayed
+		}
+		data, ok := sub.encode(next)
+		if !ok {
+			return nil
+		}
+		return writeEvent(rc, w, next.msg, data)
+	}
+	for {
+		var err error
+		if len(held) > 0 {
+			err, held = send(held[0]), held[1:]
+		} else {
+			select {
+			case <-r.Context().Done():
+				return
+			case next, ok := <-input.C:
+				if !ok {
+					if !input.Overflowed() {
+						return
+					}
+					// Missed some messages, the client has to reload the tree.
+					input = s.broker.Subscribe(0, sub.accepts)
+					rev = 0
+					err = writeEvent(rc, w, resyncMsg{Resync: true, Rev: s.snapshot().rev}, nil)
+					break
+				}
+				err = send(next)
+			case <-ticker.C:
+				if err = setWriteDeadline(rc); err == nil {
+					_, err = fmt.Fprint(w, ": ping\n\n")
+				}
+			}
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Print("SSE write: ", err)
+			return
+		}
+	}
+}
+
+// resyncMsg tells the client its tree is out of date and has to be reloaded.
+type resyncMsg struct {
+	Resync bool  `json:"resync"`
+	Rev    int64 `json:"rev"`
+}
+
+// writeEvent writes a message as a Server-Sent Event.
+// msgb is the JSON encoding of msg, encoded here if nil.
+func writeEvent(rc *http.ResponseController, w http.ResponseWriter, msg any, msgb []byte) error {
+	var err error
+	if msgb == nil {
+		if msgb, err = json.Marshal(msg); err != nil {
+			return err
+		}
+	}
+	if err = setWriteDeadline(rc); err != nil {
+		return err
+	}
+	switch msg := msg.(type) {
+	case updateMsg:
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Rev, msgb)
+	case leaseMsg:
+		_, err = fmt.Fprintf(w, "event: lease\ndata: %s\n\n", msgb)
+	case resyncMsg:
+		_, err = fmt.Fprintf(w, "event: resync\ndata: %s\n\n", msgb)
+	case statusMsg:
+		_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", msgb)
+	default:
+		_, err = fmt.Fprintf(w, "data: %s\n\n", msgb)
+	}
+	return err
+}
+
+func setWriteDeadline(rc *http.ResponseController) error {
+	err := rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
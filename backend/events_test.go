@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteEvent(t *testing.T) {
+	w := httptest.NewRecorder()
+	rc := http.NewResponseController(w)
+	key, value := "a/b", "v"
+	require.NoError(t, writeEvent(rc, w, updateMsg{Key: &key, Value: &value, Rev: 12}, nil))
+	require.NoError(t, writeEvent(rc, w, leaseMsg{Lease: 5, Event: "expired"}, nil))
+	require.NoError(t, writeEvent(rc, w, resyncMsg{Resync: true, Rev: 13}, nil))
+	require.NoError(t, writeEvent(rc, w, statusMsg{Status: "ready", Rev: 13}, nil))
+	require.Equal(t, `id: 12
+data: {"key":"a/b","value":"v","rev":12}
+
+event: lease
+data: {"lease":5,"event":"expired","ttl":0,"grantedttl":0}
+
+event: resync
+data: {"resync":true,"rev":13}
+
+event: status
+data: {"status":"ready","rev":13}
+
+`, w.Body.String())
+}
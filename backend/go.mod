@@ -10,6 +10,7 @@ require (
 	github.com/stretchr/testify v1.11.1
 	go.etcd.io/etcd/api/v3 v3.7.1
 	go.etcd.io/etcd/client/v3 v3.7.1
+	golang.org/x/crypto v0.54.0
 	google.golang.org/grpc v1.82.1
 )
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 1000
+	maxHistoryLimit     = 10000
+)
+
+// errPageFull stops a replay once a page of history is complete.
+var errPageFull = errors.New("page full")
+
+type historyResponse struct {
+	From       int64          `json:"from"`
+	To         int64          `json:"to"`
+	Next       int64          `json:"next,omitempty"`       // the from revision of the next page, if any
+	CompactRev int64          `json:"compactrev,omitempty"` // history before this revision is compacted
+	Local      bool           `json:"local,omitempty"`      // served from the local change history
+	Gaps       []changeGap    `json:"gaps,omitempty"`       // ranges the local change history may be missing changes of
+	Events     []changeRecord `json:"events"`
+}
+
+// handleHistory lists the changes under a prefix in a revision range, as
+// retained by etcd, or by the local change history once etcd compacted them.
+// Query parameters:
+// k - key prefix;
+// from, to - revision range, inclusive, to defaults to the current revision,
+// either can be an RFC 3339 time;
+// limit - max number of events per page, a page doesn't split a revision;
+// local - 1 to always use the local change history, which knows the users.
+func (s *apiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	cur := s.snapshot().rev
+	if cur == 0 {
+		http.Error(w, "etcd not connected", http.StatusServiceUnavailable)
+		return
+	}
+	from, err := s.parseRev(r.FormValue("from"))
+	if err != nil || from <= 0 {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	if _, err := strconv.ParseInt(r.FormValue("from"), 10, 64); err != nil {
+		from++ // the changes after the revision at the time
+	}
+	to := cur
+	if v := r.FormValue("to"); v != "" {
+		if to, err = s.parseRev(v); err != nil || to < from {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+		to = min(to, cur)
+	}
+	limit := defaultHistoryLimit
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+	}
+	prefix := r.FormValue("k")
+	if strings.HasPrefix(s.prefix, prefix) {
+		prefix = s.prefix
+	} else if !strings.HasPrefix(prefix, s.prefix) {
+		http.Error(w, "k outside of the browsed prefix", http.StatusBadRequest)
+		return
+	}
+
+	perms := s.permissions(r)
+	var res *historyResponse
+	if r.FormValue("local") == "1" {
+		if s.changes == nil {
+			http.Error(w, "local change history not enabled", http.StatusBadRequest)
+			return
+		}
+		res, err = s.getLocalHistory(prefix, from, to, limit, perms)
+	} else {
+		res, err = s.getHistory(r.Context(), prefix, from, to, limit, perms)
+	}
+	if err != nil {
+		log.Print("getHistory: ", err)
+		http.Error(w, "etcd unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// getHistory returns a page of the changes under prefix the user with perms
+// can read. The denied changes don't count towards the limit.
+func (s *apiServer) getHistory(ctx context.Context, prefix string, from, to int64, limit int, perms *permissions) (*historyResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	res := historyResponse{From: from, To: to, Events: []changeRecord{}}
+	err := s.replayEvents(ctx, prefix, from, to, func(msg updateMsg) error {
+		if !perms.canRead(*msg.Key) {
+			return nil
+		}
+		if len(res.Events) >= limit && msg.Rev != res.Events[len(res.Events)-1].Rev {
+			res.Next = msg.Rev
+			return errPageFull
+		}
+		res.Events = append(res.Events, changeRecord{updateMsg: msg})
+		return nil
+	})
+	if compacted, ok := err.(*compactedError); ok {
+		if s.changes != nil {
+			local, err := s.getLocalHistory(prefix, from, to, limit, perms)
+			if local != nil {
+				local.CompactRev = compacted.CompactRevision
+			}
+			return local, err
+		}
+		// Nothing retained from from, the history can be continued from CompactRevision.
+		res.CompactRev, res.Next = compacted.CompactRevision, compacted.CompactRevision
+		return &res, nil
+	}
+	if err != nil && err != errPageFull {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *apiServer) getLocalHistory(prefix string, from, to int64, limit int, perms *permissions) (*historyResponse, error) {
+	events, next, err := s.changes.query(prefix, from, to, limit, perms.canRead)
+	if err != nil {
+		return nil, err
+	}
+	end := to
+	if next != 0 {
+		end = next - 1
+	}
+	return &historyResponse{From: from, To: to, Next: next, Local: true, Gaps: s.changes.gapsIn(from, end), Events: events}, nil
+}
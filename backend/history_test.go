@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeWatcher replays a fixed list of events, one response per revision,
+// followed by a progress notification at rev.
+type fakeWatcher struct {
+	events     []*clientv3.Event
+	rev        int64
+	compactRev int64
+}
+
+func (f *fakeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	from := clientv3.OpGet(key, opts...).Rev()
+	ch := make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(ch)
+		send := func(resp clientv3.WatchResponse) bool {
+			resp.Header = &etcdserverpb.ResponseHeader{Revision: f.rev}
+			select {
+			case ch <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if from < f.compactRev {
+			send(clientv3.WatchResponse{Created: true, Canceled: true, CompactRevision: f.compactRev})
+			return
+		}
+		if !send(clientv3.WatchResponse{Created: true}) {
+			return
+		}
+		var batch []*clientv3.Event
+		for i, ev := range f.events {
+			if ev.Kv.ModRevision >= from && strings.HasPrefix(string(ev.Kv.Key), key) {
+				batch = append(batch, ev)
+			}
+			if len(batch) > 0 && (i == len(f.events)-1 || f.events[i+1].Kv.ModRevision != ev.Kv.ModRevision) {
+				if !send(clientv3.WatchResponse{Events: batch}) {
+					return
+				}
+				batch = nil
+			}
+		}
+		if send(clientv3.WatchResponse{}) { // progress
+			<-ctx.Done()
+		}
+	}()
+	return ch
+}
+
+func (f *fakeWatcher) RequestProgress(context.Context) error { return nil }
+
+func (f *fakeWatcher) Close() error { return nil }
+
+func putEvent(key string, rev int64) *clientv3.Event {
+	return &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte("v"), ModRevision: rev, CreateRevision: rev, Version: 1}}
+}
+
+func TestHandleHistory(t *testing.T) {
+	watcher := &fakeWatcher{rev: 13, events: []*clientv3.Event{
+		putEvent("/app/a/1", 10), putEvent("/app/a/2", 10),
+		putEvent("/app/a/1", 11),
+		putEvent("/app/b/1", 12),
+		putEvent("/app/a/3", 13),
+	}}
+	s := &apiServer{etcd: &clientv3.Client{Watcher: watcher}, prefix: "/app/"}
+	s.state.Store(&treeState{rev: 13, etcdReady: true})
+	get := func(query string) (int, *historyResponse) {
+		w := httptest.NewRecorder()
+		s.handleHistory(w, httptest.NewRequest("GET", "/api/history?"+query, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		var res historyResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res), "decode %s", query)
+		return w.Code, &res
+	}
+	keys := func(res *historyResponse) []string {
+		var keys []string
+		for _, ev := range res.Events {
+			keys = append(keys, *ev.Key)
+		}
+		return keys
+	}
+
+	_, res := get("k=/app/a/&from=10&limit=1")
+	require.Equal(t, []string{"/app/a/1", "/app/a/2"}, keys(res), "a page shouldn't split a revision")
+	require.Equal(t, int64(11), res.Next, "wrong next page")
+	_, res = get("k=/app/a/&from=11&limit=1")
+	require.Equal(t, []string{"/app/a/1"}, keys(res))
+	require.Equal(t, int64(13), res.Next, "expected the next page to skip other prefixes")
+	_, res = get("from=11&to=12")
+	require.Equal(t, []string{"/app/a/1", "/app/b/1"}, keys(res), "expected the whole prefix by default")
+	require.Zero(t, res.Next, "expected no next page")
+	require.Equal(t, int64(12), res.To)
+
+	for _, query := range []string{"", "from=x", "from=0", "from=12&to=11", "from=10&limit=0", "from=10&k=/other/", "from=10&local=1"} {
+		code, _ := get(query)
+		require.Equal(t, http.StatusBadRequest, code, "expected %q to be invalid", query)
+	}
+
+	denyA1 := &accessRules{Default: []string{"r"}, rules: map[string][]accessRule{"r": {
+		{prefix: "/app/", access: accessRead}, {prefix: "/app/a/1", exact: true, access: accessDeny},
+	}}}
+	s.acl = denyA1
+	_, res = get("k=/app/a/&from=10&limit=1")
+	require.Equal(t, []string{"/app/a/2"}, keys(res), "expected the denied keys to be hidden")
+	require.Equal(t, int64(13), res.Next, "expected the denied keys to not count towards the limit")
+	_, res = get("k=/app/a/&from=11&limit=1")
+	require.Equal(t, []string{"/app/a/3"}, keys(res), "expected a full page after the denied keys")
+	s.acl = nil
+
+	watcher.compactRev = 12
+	_, res = get("from=10")
+	require.Empty(t, res.Events, "expected no events before the compaction")
+	require.Equal(t, int64(12), res.CompactRev)
+	require.Equal(t, int64(12), res.Next, "expected to continue from the compaction")
+
+	s.changes, _ = openChangeLog(t.TempDir())
+	defer s.changes.Close()
+	for _, ev := range watcher.events {
+		require.NoError(t, s.changes.record([]updateMsg{eventMsg(ev)}, time.Now()))
+	}
+	_, res = get("k=/app/a/&from=10&to=11")
+	require.True(t, res.Local, "expected the local history past the compaction")
+	require.Equal(t, []string{"/app/a/1", "/app/a/2", "/app/a/1"}, keys(res))
+	require.Equal(t, int64(12), res.CompactRev)
+	s.acl = denyA1
+	_, res = get("k=/app/a/&from=11&limit=1&local=1")
+	require.Equal(t, []string{"/app/a/3"}, keys(res), "expected the denied keys to not count towards the local limit")
+	s.acl = nil
+	require.NoError(t, s.changes.restart(11, 12, time.Now()))
+	_, res = get("from=10&local=1")
+	require.Equal(t, []changeGap{{11, 12}}, res.Gaps, "expected the gaps of the local history")
+}
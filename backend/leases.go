@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	leaseCheckParallelism = 16               // concurrent TimeToLive calls
+	leaseCheckBatch       = 100              // max TimeToLive calls per leaseCheckPeriod
+	leaseCheckPeriod      = 1 * time.Second  // see leaseCheckBatch
+	leaseMinCheckInterval = 5 * time.Second  // don't check the same lease more often, unless signalled
+	leaseMaxCheckInterval = 5 * time.Minute  // re-check long leases occasionally
+	leaseRetryInterval    = 10 * time.Second // after a failed check
+)
+
+// leaseInfo is the last known state of a lease.
+type leaseInfo struct {
+	ID         int64
+	GrantedTTL int64     // seconds
+	TTL        int64     // remaining seconds at CheckedAt
+	CheckedAt  time.Time // zero if not checked yet
+	nextCheck  time.Time
+	trackedAt  time.Time
+}
+
+// ExpiresAt returns the expected expiry time, unless the lease is kept alive.
+func (l *leaseInfo) ExpiresAt() time.Time {
+	return l.CheckedAt.Add(time.Duration(l.TTL) * time.Second)
+}
+
+// remainingTTL returns the expected remaining seconds at now, rounded up.
+func (l *leaseInfo) remainingTTL(now time.Time) int64 {
+	remaining := l.ExpiresAt().Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// timeToLiveFunc returns the remaining and granted TTL of a lease, the
+// remaining TTL is <= 0 if the lease has expired.
+type timeToLiveFunc func(ctx context.Context, id int64) (ttl, grantedTTL int64, err error)
+
+// leaseTracker keeps track of the leases of the keys in the tree. A lease is
+// checked when the watch suggests it has changed: a key attached to it was
+// deleted, as happens when it expires, or was put after its expected expiry,
+// so it was kept alive. Otherwise leases are re-checked at their expected
+// expiry, but not more often than half their granted TTL or than
+// leaseMinCheckInterval, so that the leases kept alive are seen renewed about
+// as often as they are, and overall at most
+// leaseCheckBatch per leaseCheckPeriod. Expired leases are reported to
+// onExpired and forgotten, leases found to be kept alive to onRenewed.
+type leaseTracker struct {
+	mu         sync.Mutex
+	leases     map[int64]*leaseInfo
+	wakeCh     chan struct{}
+	timeToLive timeToLiveFunc
+	onExpired  func(ids []int64)
+	onRenewed  func(leases []leaseInfo)
+}
+
+func newLeaseTracker(timeToLive timeToLiveFunc, onExpired func(ids []int64), onRenewed func(leases []leaseInfo)) *leaseTracker {
+	return &leaseTracker{
+		leases:     make(map[int64]*leaseInfo),
+		wakeCh:     make(chan struct{}, 1),
+		timeToLive: timeToLive,
+		onExpired:  onExpired,
+		onRenewed:  onRenewed,
+	}
+}
+
+func etcdTimeToLive(etcd *clientv3.Client) timeToLiveFunc {
+	return func(ctx context.Context, id int64) (int64, int64, error) {
+		resp, err := etcd.TimeToLive(ctx, clientv3.LeaseID(id))
+		if err != nil {
+			return 0, 0, err
+		}
+		return resp.TTL, resp.GrantedTTL, nil
+	}
+}
+
+// track starts tracking the lease of a key that was put, if not tracked
+// already. If the lease was expected to have expired, it must have been kept
+// alive and is checked again.
+func (t *leaseTracker) track(id int64) {
+	if id <= 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	l, found := t.leases[id]
+	if !found {
+		t.leases[id] = &leaseInfo{ID: id, trackedAt: now}
+	}
+	recheck := found && !l.CheckedAt.IsZero() && l.ExpiresAt().Before(now) && l.nextCheck.After(now)
+	if recheck {
+		l.nextCheck = now
+	}
+	t.mu.Unlock()
+	if !found || recheck {
+		t.wake()
+	}
+}
+
+// keyDeleted checks a lease soon after a key attached to it was deleted, as
+// the lease may have expired.
+func (t *leaseTracker) keyDeleted(id int64) {
+	if id <= 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	l, found := t.leases[id]
+	recheck := found && l.nextCheck.After(now)
+	if recheck {
+		l.nextCheck = now
+	}
+	t.mu.Unlock()
+	if recheck {
+		t.wake()
+	}
+}
+
+// retain forgets the leases tracked before since that are not in ids.
+func (t *leaseTracker) retain(ids map[int64]bool, since time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, l := range t.leases {
+		if !ids[id] && l.trackedAt.Before(since) {
+			delete(t.leases, id)
+		}
+	}
+}
+
+// get returns the last known state of a lease.
+func (t *leaseTracker) get(id int64) (leaseInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, found := t.leases[id]
+	if !found {
+		return leaseInfo{}, false
+	}
+	return *l, true
+}
+
+func (t *leaseTracker) wake() {
+	select {
+	case t.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// run checks the leases as they become due, until ctx is done.
+func (t *leaseTracker) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.wakeCh:
+		case <-timer.C:
+		}
+		for {
+			start := time.Now()
+			due, next := t.due(start)
+			if len(due) == 0 {
+				timer.Reset(time.Until(next))
+				break
+			}
+			t.check(ctx, due)
+			if len(due) == leaseCheckBatch {
+				// More may be due, keep the rate of TimeToLive calls bounded.
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Until(start.Add(leaseCheckPeriod))):
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// due returns up to leaseCheckBatch leases that need to be checked at now, the
+// longest overdue first, and when the next check is needed.
+func (t *leaseTracker) due(now time.Time) ([]int64, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var due []*leaseInfo
+	next := now.Add(leaseMaxCheckInterval)
+	for _, l := range t.leases {
+		if !l.nextCheck.After(now) {
+			due = append(due, l)
+		} else if l.nextCheck.Before(next) {
+			next = l.nextCheck
+		}
+	}
+	slices.SortFunc(due, func(a, b *leaseInfo) int { return a.nextCheck.Compare(b.nextCheck) })
+	ids := make([]int64, 0, min(len(due), leaseCheckBatch))
+	for _, l := range due[:min(len(due), leaseCheckBatch)] {
+		ids = append(ids, l.ID)
+	}
+	return ids, next
+}
+
+// check calls TimeToLive for the given leases, outside of the lock.
+func (t *leaseTracker) check(ctx context.Context, ids []int64) {
+	type result struct {
+		id              int64
+		ttl, grantedTTL int64
+		err             error
+		checkedAt       time.Time
+	}
+	results := make([]result, len(ids))
+	sem := make(chan struct{}, leaseCheckParallelism)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			ttl, grantedTTL, err := t.timeToLive(cctx, id)
+			cancel()
+			results[i] = result{id, ttl, grantedTTL, err, time.Now()}
+		}()
+	}
+	wg.Wait()
+
+	var expired []int64
+	var renewed []leaseInfo
+	t.mu.Lock()
+	for _, r := range results {
+		l, found := t.leases[r.id]
+		if !found {
+			continue // forgotten in the meantime
+		}
+		if r.err != nil {
+			if ctx.Err() == nil {
+				log.Printf("TimeToLive %d: %v", r.id, r.err)
+			}
+			l.nextCheck = r.checkedAt.Add(leaseRetryInterval)
+			continue
+		}
+		if r.ttl <= 0 {
+			delete(t.leases, r.id)
+			expired = append(expired, r.id)
+			continue
+		}
+		checkedBefore, expiresBefore := !l.CheckedAt.IsZero(), l.ExpiresAt()
+		l.TTL, l.GrantedTTL, l.CheckedAt = r.ttl, r.grantedTTL, r.checkedAt
+		if checkedBefore && l.ExpiresAt().After(expiresBefore) {
+			renewed = append(renewed, *l)
+		}
+		// Check after the expected expiry. A lease that expires sooner is
+		// noticed by its keys being deleted, see keyDeleted.
+		delay := time.Duration(r.ttl)*time.Second + 100*time.Millisecond
+		minDelay := max(time.Duration(r.grantedTTL)*time.Second/2, leaseMinCheckInterval)
+		l.nextCheck = r.checkedAt.Add(min(max(delay, minDelay), leaseMaxCheckInterval))
+	}
+	t.mu.Unlock()
+	if len(expired) > 0 {
+		t.onExpired(expired)
+	}
+	if len(renewed) > 0 {
+		t.onRenewed(renewed)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseTracker(t *testing.T) {
+	var mu sync.Mutex
+	ttls := map[int64]int64{1: 60, 2: 1, 3: 8}
+	timeToLive := func(_ context.Context, id int64) (int64, int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ttl := ttls[id]
+		ttls[id] = 0 // expires after the first check
+		granted := int64(60)
+		if id == 3 {
+			granted = 10
+		}
+		return ttl, granted, nil
+	}
+	expiredCh := make(chan []int64, 1)
+	tracker := newLeaseTracker(timeToLive, func(ids []int64) { expiredCh <- ids }, func([]leaseInfo) {})
+
+	tracker.track(1)
+	tracker.track(2)
+	tracker.track(3)
+	tracker.track(0)
+	due, _ := tracker.due(time.Now())
+	require.ElementsMatch(t, []int64{1, 2, 3}, due, "new leases expected to be due")
+	tracker.check(context.Background(), due)
+	l, found := tracker.get(1)
+	require.True(t, found, "lease 1 expected to be tracked")
+	require.Equal(t, int64(60), l.TTL, "wrong lease 1 TTL")
+	require.Equal(t, int64(60), l.GrantedTTL, "wrong lease 1 granted TTL")
+	require.Equal(t, int64(60), l.remainingTTL(l.CheckedAt), "wrong lease 1 remaining TTL")
+	require.Equal(t, int64(30), l.remainingTTL(l.CheckedAt.Add(30500*time.Millisecond)), "wrong lease 1 remaining TTL")
+	require.Equal(t, int64(0), l.remainingTTL(l.CheckedAt.Add(time.Hour)), "wrong lease 1 remaining TTL")
+
+	l, _ = tracker.get(3)
+	require.Equal(t, l.CheckedAt.Add(8100*time.Millisecond), l.nextCheck, "a short lease expected to be checked at its expected expiry")
+	delete(tracker.leases, 3)
+	due, next := tracker.due(time.Now())
+	require.Empty(t, due, "no leases expected to be due")
+	require.WithinDuration(t, time.Now().Add(30*time.Second), next, 500*time.Millisecond, "lease 2 check expected no sooner than half its granted TTL")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tracker.run(ctx)
+	tracker.keyDeleted(2)
+	select {
+	case ids := <-expiredCh:
+		require.Equal(t, []int64{2}, ids, "lease 2 expected to expire")
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease 2 did not expire")
+	}
+	_, found = tracker.get(2)
+	require.False(t, found, "expired lease expected to be forgotten")
+
+	tracker.retain(map[int64]bool{}, time.Now())
+	_, found = tracker.get(1)
+	require.False(t, found, "unused lease expected to be forgotten")
+}
+
+func TestLeaseTrackerSignals(t *testing.T) {
+	tracker := newLeaseTracker(nil, nil, nil)
+	for id := range int64(leaseCheckBatch + 50) {
+		tracker.track(id + 1)
+	}
+	due, _ := tracker.due(time.Now())
+	require.Len(t, due, leaseCheckBatch, "expected the checks to be batched")
+
+	now := time.Now()
+	tracker.leases[1].TTL, tracker.leases[1].CheckedAt, tracker.leases[1].nextCheck = 60, now, now.Add(time.Minute)
+	tracker.track(1)
+	require.Equal(t, now.Add(time.Minute), tracker.leases[1].nextCheck, "expected a put before the expected expiry to not be checked")
+	tracker.leases[1].CheckedAt = now.Add(-time.Hour)
+	tracker.track(1)
+	require.False(t, tracker.leases[1].nextCheck.After(time.Now()), "expected a put after the expected expiry to be checked")
+
+	tracker.leases[2].nextCheck = now.Add(time.Minute)
+	tracker.keyDeleted(2)
+	require.False(t, tracker.leases[2].nextCheck.After(time.Now()), "expected a deleted key's lease to be checked")
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -27,6 +31,25 @@ var (
 	username       = env("USERNAME", "", "supply username to etcd")
 	password       = env("PASSWORD", "", "supply password to etcd")
 	prefix         = env("PREFIX", "", "browse KVs under the given prefix")
+	loadPageSize   = envInt("LOAD_PAGE_SIZE", 10000, "number of keys to fetch per request during the initial load")
+	recentEvents   = envInt("RECENT_EVENTS", 10000, "number of recent updates kept in memory")
+	recentMaxAge   = envInt("RECENT_EVENTS_MAX_AGE", 3600, "seconds recent updates are kept in memory")
+	historyDir     = env("HISTORY_DIR", "", "directory to keep the local change history and revision index in")
+	authUsers      = env("AUTH_USERS", "", "file with local users and bcrypt password hashes")
+	authProxy      = env("AUTH_PROXY_HEADER", "", "trusted reverse proxy header with the user name, e.g. X-Forwarded-User")
+	authProxyGroup = env("AUTH_PROXY_GROUPS_HEADER", "", "trusted reverse proxy header with the user's groups")
+	trustedProxies = env("AUTH_TRUSTED_PROXIES", "127.0.0.0/8,::1/128", "comma-separated CIDRs of the trusted reverse proxies")
+	sessionTTL     = envInt("SESSION_TTL", 43200, "seconds a login session lasts")
+	oidcIssuer     = env("OIDC_ISSUER", "", "OpenID Connect issuer URL, enables SSO login")
+	oidcClientID   = env("OIDC_CLIENT_ID", "", "OpenID Connect client ID")
+	oidcSecret     = env("OIDC_CLIENT_SECRET", "", "OpenID Connect client secret, optional")
+	oidcRedirect   = env("OIDC_REDIRECT_URL", "", "the browser's /oidc/callback URL registered at the issuer")
+	oidcScopes     = env("OIDC_SCOPES", "profile groups", "OpenID Connect scopes requested in addition to openid")
+	oidcUserClaim  = env("OIDC_USERNAME_CLAIM", "preferred_username", "ID token claim with the user name")
+	oidcGroupClaim = env("OIDC_GROUPS_CLAIM", "groups", "ID token claim with the user's groups")
+	oidcGroupRoles = env("OIDC_GROUP_ROLES", "", "comma-separated group=role mapping of the issuer's groups")
+	aclFile        = env("ACCESS_RULES", "", "file with the access rules of roles, users and groups")
+	etcdUserAuth   = envInt("ETCD_USER_AUTH", 0, "log users in with their own etcd credentials")
 )
 
 func main() {
@@ -57,23 +80,57 @@ func main() {
 		clientConfig.Password = password
 	}
 
+	if loadPageSize <= 0 {
+		log.Fatal("LOAD_PAGE_SIZE must be positive") // etcd treats a limit of 0 as none
+	}
 	etcdClient, err := clientv3.New(clientConfig)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "etcd client"))
 	}
-	server := newServer(etcdClient, editable == 1, prefix)
+	recent := newRecentLog(recentEvents, time.Duration(recentMaxAge)*time.Second)
+	var changes *changeLog
+	if historyDir != "" {
+		if changes, err = openChangeLog(historyDir); err != nil {
+			log.Fatal(errors.Wrap(err, "change history"))
+		}
+	}
+	revs, err := newRevIndex(historyDir)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "revision index"))
+	}
+	var acl *accessRules
+	if aclFile != "" {
+		if acl, err = loadAccessRules(aclFile); err != nil {
+			log.Fatal(errors.Wrap(err, "access rules"))
+		}
+	}
+	server := newServer(etcdClient, serverConfig{
+		Editable: editable == 1,
+		Prefix:   prefix,
+		PageSize: int64(loadPageSize),
+		Recent:   recent,
+		Changes:  changes,
+		Revs:     revs,
+		ACL:      acl,
+		Origins:  splitList(allowedOrigins),
+	})
+	server.registerMetrics()
 
 	mux := http.DefaultServeMux
 	if pprof == 0 {
 		mux = http.NewServeMux()
 	}
-	mux.HandleFunc("/debug/health", healthCheck)
+	mux.HandleFunc("/debug/health", server.handleHealth)
 	mux.Handle("/metrics", promhttp.Handler())
 
 	mux.HandleFunc("/test", handleTestPage)
 	mux.HandleFunc("/api/list", server.handleList)
 	mux.HandleFunc("/api/kv", server.handleOne)
 	mux.HandleFunc("/api/kvws", server.handleWebsocket)
+	mux.HandleFunc("/api/usage", server.handleUsage)
+	mux.HandleFunc("/api/events", server.handleEvents)
+	mux.HandleFunc("/api/events/recent", server.handleRecentEvents)
+	mux.HandleFunc("/api/history", server.handleHistory)
 
 	mux.Handle("/", http.FileServer(http.Dir("dist"))) // serves the frontend in a production image
 
@@ -84,7 +141,64 @@ func main() {
 		// Debug:          true,
 	})
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", httpPort), cors.Handler(mux)))
+	var handler http.Handler = mux
+	authCfg := authConfig{
+		UsersFile:         authUsers,
+		ProxyHeader:       authProxy,
+		ProxyGroupsHeader: authProxyGroup,
+		TrustedProxies:    trustedProxies,
+		SessionTTL:        time.Duration(sessionTTL) * time.Second,
+	}
+	if oidcIssuer != "" {
+		groupRoles, err := parseGroupRoles(oidcGroupRoles)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "OIDC_GROUP_ROLES"))
+		}
+		authCfg.OIDC = &oidcConfig{
+			Issuer:        oidcIssuer,
+			ClientID:      oidcClientID,
+			ClientSecret:  oidcSecret,
+			RedirectURL:   oidcRedirect,
+			Scopes:        oidcScopes,
+			UsernameClaim: oidcUserClaim,
+			GroupsClaim:   oidcGroupClaim,
+			GroupRoles:    groupRoles,
+		}
+	}
+	if etcdUserAuth == 1 {
+		authCfg.EtcdLogin = newEtcdLogin(clientConfig)
+	}
+	authn, err := newAuth(authCfg)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "auth"))
+	}
+	if authn != nil {
+		handler = authn.handler(mux)
+	} else {
+		log.Print("Authentication is disabled")
+	}
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", httpPort), Handler: cors.Handler(handler)}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Print("Shutting down")
+	if changes != nil {
+		if err = changes.Close(); err != nil {
+			log.Print("changes.Close: ", err)
+		}
+	}
+	if err = revs.Close(); err != nil {
+		log.Print("revs.Close: ", err)
+	}
 }
 
 var templates = template.Must(template.ParseGlob("templates/*.gohtml"))
@@ -0,0 +1,29 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// registerMetrics exports the server state to the default Prometheus registry.
+func (s *apiServer) registerMetrics() {
+	gauge := func(name, help string, fn func(st *treeState) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: "etcdv3_browser", Name: name, Help: help},
+			func() float64 { return fn(s.snapshot()) })
+	}
+	prometheus.MustRegister(
+		gauge("keys", "Number of keys in the tree.", func(st *treeState) float64 { return float64(st.root.Keys) }),
+		gauge("revision", "Revision of the tree.", func(st *treeState) float64 { return float64(st.rev) }),
+		gauge("loading", "1 while the initial load is in progress.", func(st *treeState) float64 { return boolToFloat(st.loading) }),
+		gauge("etcd_ready", "1 if connected to etcd and the tree is complete.", func(st *treeState) float64 { return boolToFloat(st.etcdReady) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "etcdv3_browser",
+			Name:      "broker_dropped_total",
+			Help:      "Number of messages not delivered to slow clients, which were then told to resync.",
+		}, func() float64 { return float64(s.broker.Dropped()) }),
+	)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
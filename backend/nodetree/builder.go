@@ -0,0 +1,69 @@
+package nodetree
+
+import (
+	"maps"
+	"sync/atomic"
+)
+
+var lastGeneration atomic.Uint64
+
+// Builder applies changes to a tree without modifying it (copy-on-write).
+// Nodes on a changed path are copied the first time the Builder touches them,
+// everything else is shared with the original tree. The original tree is never
+// modified, so it can be read concurrently while the Builder is in use.
+// A Builder itself is not thread-safe.
+type Builder struct {
+	root *Node
+	gen  uint64
+}
+
+// NewBuilder starts a batch of changes on top of root.
+func NewBuilder(root *Node) *Builder {
+	return &Builder{root: root, gen: lastGeneration.Add(1)}
+}
+
+// AddNode adds a new node by path.
+func (b *Builder) AddNode(path string, leaseID int64) {
+	b.PutNode(path, Meta{LeaseID: leaseID})
+}
+
+// PutNode adds or updates a node by path.
+func (b *Builder) PutNode(path string, meta Meta) {
+	b.root = b.own(b.root)
+	b.putNode(b.root, path, meta)
+}
+
+// DeleteNode removes a node by path.
+func (b *Builder) DeleteNode(path string) {
+	b.root = b.own(b.root)
+	b.deleteNode(b.root, path)
+}
+
+// Root returns the resulting tree. The returned tree must no longer be
+// modified, further changes made through the Builder will copy it again.
+func (b *Builder) Root() *Node {
+	root := b.root
+	b.gen = lastGeneration.Add(1)
+	return root
+}
+
+func (b *Builder) generation() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.gen
+}
+
+// own returns a copy of n that can be modified by the Builder.
+// A nil Builder modifies in place.
+func (b *Builder) own(n *Node) *Node {
+	if b == nil || n.gen == b.gen {
+		return n
+	}
+	c := *n
+	c.gen = b.gen
+	if n.next != nil {
+		c.next = maps.Clone(n.next)
+	}
+	return &c
+}
@@ -6,17 +6,44 @@ import (
 
 // Node implements a single node in a recursive tree.
 // For space reasons no values are stored, only the fact that there was a value.
-// Not thread-safe.
+// AddNode and DeleteNode modify the tree in place and are not thread-safe; use a
+// Builder to derive a new tree while readers keep using the old one.
 type Node struct {
-	Key      string
-	LeaseID  int64
+	Key string
+	Meta
 	next     map[string]*Node
 	HasValue bool
+	// Aggregates over the subtree, including the node itself.
+	Keys            int64  // number of keys
+	Bytes           int64  // total value size of keys with a known size
+	Unsized         int64  // number of keys with an unknown size
+	LastModRevision int64  // latest ModRevision of the keys in the subtree
+	gen             uint64 // id of the Builder that created this node, 0 if none
+}
+
+// Meta is the metadata of a key, valid only if the node HasValue.
+type Meta struct {
+	LeaseID        int64
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Size           int64 // value size in bytes, negative if unknown
+}
+
+func (m *Meta) knownSize() int64 {
+	return max(m.Size, 0)
+}
+
+func (m *Meta) unsized() int64 {
+	if m.Size < 0 {
+		return 1
+	}
+	return 0
 }
 
 // NewNode should be used to create a node.
 func NewNode(key string, leaseID int64) *Node {
-	return &Node{Key: key, LeaseID: leaseID}
+	return &Node{Key: key, Meta: Meta{LeaseID: leaseID}}
 }
 
 // Count returns the number of sub-nodes.
@@ -74,56 +101,128 @@ func (n *Node) GetNode(path string) *Node {
 	return root
 }
 
-// AddNode adds a new node by path.
+// FirstUnsized returns the path under n of the first key in byte order with an
+// unknown size, and false if there is none.
+func (n *Node) FirstUnsized() (string, bool) {
+	if n.Unsized == 0 {
+		return "", false
+	}
+	if n.HasValue && n.Size < 0 {
+		return "", true
+	}
+	// The keys under a path element sort together, so the smallest one with an
+	// unsized key comes first.
+	first := ""
+	for name, child := range n.next {
+		if child.Unsized > 0 && (first == "" || name < first) {
+			first = name
+		}
+	}
+	if first == "" {
+		return "", false
+	}
+	path, found := n.next[first].FirstUnsized()
+	return first + path, found
+}
+
+// AddNode adds a new node by path, modifying the tree in place.
 func (n *Node) AddNode(path string, leaseID int64) *Node {
+	return (*Builder)(nil).putNode(n, path, Meta{LeaseID: leaseID})
+}
+
+// PutNode adds or updates a node by path, modifying the tree in place.
+func (n *Node) PutNode(path string, meta Meta) *Node {
+	return (*Builder)(nil).putNode(n, path, meta)
+}
+
+// DeleteNode removes a node by path, modifying the tree in place.
+func (n *Node) DeleteNode(path string) {
+	(*Builder)(nil).deleteNode(n, path)
+}
+
+func (b *Builder) putNode(n *Node, path string, meta Meta) *Node {
 	str := splitPath(&path)
+	nodes := make([]*Node, 1, len(str)+1)
+	nodes[0] = n
 	root := n
 	for _, el := range str {
 		next := root.getNext(el)
 		if next == nil {
-			next = NewNode(el, leaseID)
-			root.setNext(el, next)
+			next = &Node{Key: el, gen: b.generation()}
+		} else {
+			next = b.own(next)
 		}
+		root.setNext(el, next)
+		nodes = append(nodes, next)
 		root = next
 	}
+	keys, bytes, unsized := int64(1), meta.knownSize(), meta.unsized()
+	if root.HasValue {
+		keys, bytes, unsized = 0, bytes-root.knownSize(), unsized-root.unsized()
+	}
+	root.Meta = meta
 	root.HasValue = true
+	for _, node := range nodes {
+		node.Keys += keys
+		node.Bytes += bytes
+		node.Unsized += unsized
+		node.LastModRevision = max(node.LastModRevision, meta.ModRevision)
+	}
 	return root
 }
 
-// DeleteNode removes a node by path.
-func (n *Node) DeleteNode(path string) {
+func (b *Builder) deleteNode(n *Node, path string) {
 	str := splitPath(&path)
 	if len(str) == 0 {
 		return
 	}
+	parents := make([]*Node, 0, len(str))
 	root := n
-	next := root
-	var base *Node
-	var baseKey string
-	var lastKey string
-	for i, el := range str {
-		root = next
-		next = root.getNext(el)
-		if next == nil {
+	for _, el := range str[:len(str)-1] {
+		parents = append(parents, root)
+		root = root.getNext(el)
+		if root == nil {
 			return
 		}
-		if len(next.next) <= 1 && !next.HasValue {
-			if base == nil {
-				base = root
-				baseKey = el
-			}
-		} else if i < len(str)-1 {
-			base = nil
+	}
+	if root.getNext(str[len(str)-1]) == nil {
+		return
+	}
+	parents = append(parents, root)
+	removed := root.getNext(str[len(str)-1])
+	// Copy the path top-down, then delete bottom-up, pruning empty directories.
+	for i := range parents {
+		if i > 0 {
+			parents[i] = b.own(parents[i])
+			parents[i-1].setNext(str[i-1], parents[i])
 		}
-		lastKey = el
+		parents[i].Keys -= removed.Keys
+		parents[i].Bytes -= removed.Bytes
+		parents[i].Unsized -= removed.Unsized
 	}
-	if base != nil {
-		root = base // delete the entire empty subtree
-		lastKey = baseKey
-
+	for i := len(parents) - 1; i >= 0; i-- {
+		parent := parents[i]
+		delete(parent.next, str[i])
+		if len(parent.next) == 0 {
+			parent.next = nil // invariant: no children = no map
+		}
+		if i == 0 || parent.next != nil || parent.HasValue {
+			break
+		}
 	}
-	delete(root.next, lastKey)
-	if len(root.next) == 0 {
-		root.next = nil // invariant: no children = no map
+	// Only the directories whose latest revision was in the removed subtree
+	// need it recomputed, and then only from their direct children.
+	for i := len(parents) - 1; i >= 0; i-- {
+		parent := parents[i]
+		if parent.LastModRevision > removed.LastModRevision {
+			break
+		}
+		parent.LastModRevision = 0
+		if parent.HasValue {
+			parent.LastModRevision = parent.ModRevision
+		}
+		for _, child := range parent.next {
+			parent.LastModRevision = max(parent.LastModRevision, child.LastModRevision)
+		}
 	}
 }
@@ -57,3 +57,85 @@ func TestAddDelete(t *testing.T) {
 	require.Nil(t, n.GetNode("a/d/"), "a/d/ expected to be gone")
 	require.Equal(t, "b", n.GetNode("a/b").Key, "a/b expected to exist")
 }
+
+func TestBuilder(t *testing.T) {
+	n := NewNode("", 0)
+	n.AddNode("a/b", 0)
+	n.AddNode("a/c", 0)
+	n.AddNode("x/y/z", 0)
+
+	b := NewBuilder(n)
+	b.AddNode("a/d", 7)
+	b.DeleteNode("x/y/z")
+	b.DeleteNode("a/b")
+	m := b.Root()
+
+	require.NotNil(t, n.GetNode("a/b"), "original a/b expected to exist")
+	require.NotNil(t, n.GetNode("x/y/z"), "original x/y/z expected to exist")
+	require.Nil(t, n.GetNode("a/d"), "original a/d expected to not exist")
+	require.Equal(t, 2, n.GetNode("a/").Count(), "wrong original a/ size")
+
+	require.Nil(t, m.GetNode("a/b"), "a/b expected to be gone")
+	require.Nil(t, m.GetNode("x/"), "x/ expected to be gone")
+	require.Equal(t, int64(7), m.GetNode("a/d").LeaseID, "wrong a/d lease")
+	require.Same(t, n.GetNode("a/c"), m.GetNode("a/c"), "a/c expected to be shared")
+
+	b.AddNode("a/e", 0)
+	require.Nil(t, m.GetNode("a/e"), "published tree expected to be immutable")
+	require.NotNil(t, b.Root().GetNode("a/e"), "a/e expected to exist")
+}
+
+func TestAggregates(t *testing.T) {
+	n := NewNode("", 0)
+	n.PutNode("a/b", Meta{ModRevision: 2, Size: 10})
+	n.PutNode("a/c/d", Meta{ModRevision: 3, Size: 5})
+	n.PutNode("a/c/e", Meta{ModRevision: 4, Size: 1})
+	n.PutNode("x", Meta{ModRevision: 5, Size: 100})
+	require.Equal(t, int64(4), n.Keys, "wrong root keys")
+	require.Equal(t, int64(116), n.Bytes, "wrong root bytes")
+	require.Equal(t, int64(16), n.GetNode("a/").Bytes, "wrong a/ bytes")
+	require.Equal(t, int64(4), n.GetNode("a/").LastModRevision, "wrong a/ modrev")
+
+	n.PutNode("a/c/d", Meta{ModRevision: 6, Version: 2, Size: 7})
+	require.Equal(t, int64(3), n.GetNode("a/").Keys, "update expected to keep a/ keys")
+	require.Equal(t, int64(18), n.GetNode("a/").Bytes, "wrong a/ bytes after update")
+	require.Equal(t, int64(6), n.GetNode("a/c/").LastModRevision, "wrong a/c/ modrev")
+
+	b := NewBuilder(n)
+	b.DeleteNode("a/c/")
+	m := b.Root()
+	require.Equal(t, int64(2), m.Keys, "wrong root keys after delete")
+	require.Equal(t, int64(110), m.Bytes, "wrong root bytes after delete")
+	require.Equal(t, int64(4), n.Keys, "original root keys expected to be unchanged")
+	require.Equal(t, int64(2), m.GetNode("a/").LastModRevision, "expected a/ modrev to drop with its latest key")
+	require.Equal(t, int64(6), n.GetNode("a/").LastModRevision, "original a/ modrev expected to be unchanged")
+	require.Equal(t, int64(5), m.LastModRevision, "wrong root modrev after delete")
+}
+
+func TestUnknownSize(t *testing.T) {
+	n := NewNode("", 0)
+	n.PutNode("a/b", Meta{Size: -1})
+	n.PutNode("a/c", Meta{Size: 3})
+	require.Equal(t, int64(3), n.Bytes, "wrong bytes")
+	require.Equal(t, int64(1), n.Unsized, "wrong unsized")
+	n.PutNode("a/b", Meta{Size: 4})
+	require.Equal(t, int64(7), n.Bytes, "wrong bytes after size is known")
+	require.Equal(t, int64(0), n.Unsized, "wrong unsized after size is known")
+	n.PutNode("a/d", Meta{Size: -1})
+	n.DeleteNode("a/")
+	require.Equal(t, int64(0), n.Unsized, "wrong unsized after delete")
+
+	for _, key := range []string{"b/x", "a-b/c", "a/c", "a/b", "a"} {
+		n.PutNode(key, Meta{Size: -1})
+	}
+	var order []string
+	for {
+		key, found := n.FirstUnsized()
+		if !found {
+			break
+		}
+		order = append(order, key)
+		n.PutNode(key, Meta{Size: 1})
+	}
+	require.Equal(t, []string{"a", "a-b/c", "a/b", "a/c", "b/x"}, order, "expected the unsized keys in byte order")
+}
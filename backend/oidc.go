@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	oidcStateCookie = "etcdv3-browser-oidc"
+	oidcLoginTTL    = 10 * time.Minute // time to complete a login at the issuer
+	oidcClockSkew   = time.Minute
+	oidcMetadataTTL = time.Hour // age of the issuer metadata to fetch it again
+)
+
+type oidcConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string // optional with PKCE
+	RedirectURL   string // e.g. https://browser.example.com/oidc/callback
+	Scopes        string // space-separated, openid is always requested
+	UsernameClaim string
+	GroupsClaim   string
+	GroupRoles    map[string]string // issuer group to browser role, nil to keep the groups as-is
+}
+
+// oidcProvider logs users in with the OpenID Connect authorization code flow
+// with PKCE. The issuer metadata and keys are fetched on first use, and again
+// when the metadata is older than oidcMetadataTTL or a key is unknown.
+type oidcProvider struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	meta     *oidcMetadata
+	metaTime time.Time
+	keys     map[string]*rsa.PublicKey // by key ID
+	keysTime time.Time
+	pending  map[string]*oidcLogin // by state
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a login in progress at the issuer.
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+func newOIDCProvider(cfg oidcConfig) *oidcProvider {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return &oidcProvider{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: map[string]*oidcLogin{},
+	}
+}
+
+// parseGroupRoles parses a group=role,... mapping.
+func parseGroupRoles(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	res := map[string]string{}
+	for _, v := range splitList(s) {
+		group, role, found := strings.Cut(v, "=")
+		if !found || group == "" || role == "" {
+			return nil, fmt.Errorf("invalid group mapping %q, expected group=role", v)
+		}
+		res[group] = role
+	}
+	return res, nil
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// metadata returns the issuer metadata. If refreshing it fails, the previous
+// metadata is used.
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	old, fresh := p.meta, time.Since(p.metaTime) < oidcMetadataTTL
+	p.mu.Unlock()
+	if old != nil && fresh {
+		return old, nil
+	}
+	meta := &oidcMetadata{}
+	err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", meta)
+	if err == nil && meta.Issuer != p.cfg.Issuer {
+		err = fmt.Errorf("issuer %q doesn't match %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if err != nil {
+		if old != nil {
+			log.Print("OIDC discovery, using the previous metadata: ", err)
+			return old, nil
+		}
+		return nil, errors.Wrap(err, "discovery")
+	}
+	p.mu.Lock()
+	p.meta, p.metaTime = meta, time.Now()
+	p.mu.Unlock()
+	return meta, nil
+}
+
+// key returns the issuer's signing key, refreshing the keys when the key ID
+// is unknown, at most once a minute.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, found := p.keys[kid]
+	stale := time.Since(p.keysTime) > time.Minute
+	p.mu.Unlock()
+	if found || !stale {
+		if key == nil {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key, nil
+	}
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = p.getJSON(ctx, meta.JWKSURI, &jwks); err != nil {
+		return nil, errors.Wrap(err, "jwks")
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.mu.Lock()
+	p.keys, p.keysTime = keys, time.Now()
+	p.mu.Unlock()
+	if key = keys[kid]; key == nil {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// handleLogin redirects to the issuer to log in.
+func (p *oidcProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	meta, err := p.metadata(r.Context())
+	if err != nil {
+		log.Print("OIDC: ", err)
+		http.Error(w, "identity provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	state, login := randomString(16), &oidcLogin{verifier: randomString(32), nonce: randomString(16), expires: time.Now().Add(oidcLoginTTL)}
+	now := time.Now()
+	p.mu.Lock()
+	for state, l := range p.pending {
+		if now.After(l.expires) {
+			delete(p.pending, state)
+		}
+	}
+	p.pending[state] = login
+	p.mu.Unlock()
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, strings.Fields(p.cfg.Scopes)...), " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	// Ties the login to this browser.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callback completes a login with the authorization code from the issuer.
+func (p *oidcProvider) callback(r *http.Request) (*User, error) {
+	if e := r.FormValue("error"); e != "" {
+		return nil, fmt.Errorf("issuer: %s %s", e, r.FormValue("error_description"))
+	}
+	state := r.FormValue("state")
+	if c, err := r.Cookie(oidcStateCookie); err != nil || c.Value != state {
+		return nil, errors.New("state doesn't match the browser")
+	}
+	p.mu.Lock()
+	login := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if login == nil || time.Now().After(login.expires) {
+		return nil, errors.New("unknown or expired state")
+	}
+	rawToken, err := p.exchange(r.Context(), r.FormValue("code"), login.verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verifyIDToken(r.Context(), rawToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return nil, errors.New("nonce doesn't match")
+	}
+	return p.user(claims)
+}
+
+// exchange redeems the authorization code for an ID token.
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "token")
+	}
+	defer resp.Body.Close()
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return "", errors.Wrap(err, "token")
+	}
+	if resp.StatusCode != http.StatusOK || res.IDToken == "" {
+		return "", fmt.Errorf("token: %s %s %s", resp.Status, res.Error, res.ErrorDescription)
+	}
+	return res.IDToken, nil
+}
+
+// verifyIDToken checks the RS256 signature of an ID token against the issuer's
+// keys, its issuer, audience and authorized party, and its validity period.
+// Returns the claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "ID token header")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "ID token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, errors.Wrap(err, "ID token signature")
+	}
+	var claims map[string]any
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "ID token claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, fmt.Errorf("ID token issuer %q doesn't match", iss)
+	}
+	aud := stringsClaim(claims["aud"])
+	if !slices.Contains(aud, p.cfg.ClientID) {
+		return nil, errors.New("ID token not issued for this client")
+	}
+	if azp, found := claims["azp"]; (found || len(aud) > 1) && azp != p.cfg.ClientID {
+		return nil, errors.New("ID token not authorized for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, errors.New("ID token expired")
+	}
+	for _, claim := range []string{"nbf", "iat"} {
+		if t, found := claims[claim].(float64); found && now.Add(oidcClockSkew).Before(time.Unix(int64(t), 0)) {
+			return nil, fmt.Errorf("ID token not valid yet, %s in the future", claim)
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// stringsClaim returns a claim that is either a string or an array of strings.
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var res []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// user maps the ID token claims to a browser user, with the groups mapped to
+// roles. The access rules know the user by the subject, which the issuer
+// doesn't reassign, unlike the user name.
+func (p *oidcProvider) user(claims map[string]any) (*User, error) {
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	name, _ := claims[p.cfg.UsernameClaim].(string)
+	if name == "" {
+		name = sub
+	}
+	u := &User{Name: name, ruleName: "oidc:" + sub}
+	for _, group := range stringsClaim(claims[p.cfg.GroupsClaim]) {
+		if p.cfg.GroupRoles == nil {
+			u.Groups = append(u.Groups, group)
+		} else if role, found := p.cfg.GroupRoles[group]; found && !slices.Contains(u.Groups, role) {
+			u.Groups = append(u.Groups, role)
+		}
+	}
+	return u, nil
+}
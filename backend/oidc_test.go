@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// mockIssuer is a minimal OpenID Connect issuer.
+type mockIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string // the PKCE challenge of the last authorization
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]any{"iss": m.URL, "aud": "browser", "exp": time.Now().Add(time.Hour).Unix(), "nonce": m.nonce}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": signJWT(t, key, "k1", claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.claims = map[string]any{"sub": "c1", "preferred_username": "carol", "groups": []string{"etcd-admins", "other"}}
+	a, err := newAuth(authConfig{SessionTTL: time.Hour, OIDC: &oidcConfig{
+		Issuer:      issuer.URL,
+		ClientID:    "browser",
+		RedirectURL: "http://browser/oidc/callback",
+		GroupRoles:  map[string]string{"etcd-admins": "admin"},
+	}})
+	require.NoError(t, err, "newAuth")
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := userFromContext(r.Context())
+		fmt.Fprint(w, u.Name, u.Groups)
+	}))
+	do := func(r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, "/oidc/login", w.Header().Get("Location"), "expected a redirect to the SSO login")
+
+	w = do(httptest.NewRequest("GET", "/oidc/login", nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, issuer.URL+"/authorize", loc.Scheme+"://"+loc.Host+loc.Path, "expected a redirect to the issuer")
+	q := loc.Query()
+	require.Equal(t, "S256", q.Get("code_challenge_method"))
+	require.Equal(t, "openid", q.Get("scope"))
+	issuer.challenge, issuer.nonce = q.Get("code_challenge"), q.Get("nonce")
+	stateCookie := w.Result().Cookies()[0]
+
+	callback := "/oidc/callback?" + url.Values{"code": {"good-code"}, "state": {q.Get("state")}}.Encode()
+	w = do(httptest.NewRequest("GET", callback, nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code, "expected the state to be tied to the browser")
+
+	// The failed attempt above doesn't consume the state.
+	w = do(httptest.NewRequest("GET", callback, nil), stateCookie)
+	require.Equal(t, http.StatusFound, w.Code, "expected a successful login: %s", w.Body)
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	require.NotNil(t, session, "expected a session cookie")
+	w = do(httptest.NewRequest("GET", "/api/list", nil), session)
+	require.Equal(t, "carol[admin]", w.Body.String(), "expected the groups to be mapped to roles")
+
+	w = do(httptest.NewRequest("GET", callback, nil), stateCookie)
+	require.Equal(t, http.StatusUnauthorized, w.Code, "expected the state to be usable once")
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := newOIDCProvider(oidcConfig{Issuer: issuer.URL, ClientID: "browser"})
+	now := time.Now()
+	valid := func() map[string]any {
+		return map[string]any{"iss": issuer.URL, "aud": []string{"other", "browser"}, "azp": "browser", "exp": now.Add(time.Hour).Unix(), "iat": now.Unix(), "sub": "u1"}
+	}
+	claims, err := p.verifyIDToken(context.Background(), signJWT(t, issuer.key, "k1", valid()), now)
+	require.NoError(t, err, "expected a valid token")
+	u, err := p.user(claims)
+	require.NoError(t, err)
+	require.Equal(t, "u1", u.Name, "expected the subject without a user name claim")
+	require.Equal(t, "oidc:u1", u.ruleName, "expected the access rules to know the user by the subject")
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = p.verifyIDToken(context.Background(), signJWT(t, otherKey, "k1", valid()), now)
+	require.ErrorContains(t, err, "signature", "expected a wrong key to fail")
+	_, err = p.verifyIDToken(context.Background(), signJWT(t, issuer.key, "k2", valid()), now)
+	require.ErrorContains(t, err, "unknown key", "expected an unknown key to fail")
+
+	for name, change := range map[string]func(c map[string]any){
+		"issuer":           func(c map[string]any) { c["iss"] = "https://evil" },
+		"audience":         func(c map[string]any) { c["aud"] = "other" },
+		"authorized party": func(c map[string]any) { c["azp"] = "other" },
+		"missing azp":      func(c map[string]any) { delete(c, "azp") },
+		"expired":          func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() },
+		"not before":       func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() },
+		"issued at":        func(c map[string]any) { c["iat"] = now.Add(time.Hour).Unix() },
+	} {
+		c := valid()
+		change(c)
+		_, err = p.verifyIDToken(context.Background(), signJWT(t, issuer.key, "k1", c), now)
+		require.Error(t, err, "expected a wrong %s to fail", name)
+	}
+	_, err = p.verifyIDToken(context.Background(), "a.b", now)
+	require.Error(t, err, "expected a malformed token to fail")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	pastTreeCacheSize = 4 // trees at past revisions kept in memory, and loading at once
+	pastTreeTimeout   = time.Minute
+)
+
+var errPastTreesBusy = errors.New("too many past trees loading")
+
+type pastTree struct {
+	ready  chan struct{} // closed when st or err is set
+	st     *treeState
+	err    error
+	used   time.Time
+	loaded bool // ready is closed, under the lock
+}
+
+// pastTrees is a cache of read-only trees at past revisions, for browsing the
+// keys as they were at the time. The trees being loaded are not evicted, and
+// count towards the cache size, which bounds the concurrent loads too.
+type pastTrees struct {
+	mu      sync.Mutex
+	trees   map[int64]*pastTree
+	loading int
+	load    func(ctx context.Context, rev int64) (*treeState, error)
+}
+
+func newPastTrees(load func(ctx context.Context, rev int64) (*treeState, error)) *pastTrees {
+	return &pastTrees{trees: map[int64]*pastTree{}, load: load}
+}
+
+// get returns the tree at revision rev, loading it if not cached. Concurrent
+// requests for the same revision share the load. Returns errPastTreesBusy if
+// the cache is full of trees being loaded.
+func (c *pastTrees) get(ctx context.Context, rev int64) (*treeState, error) {
+	c.mu.Lock()
+	t, found := c.trees[rev]
+	if found {
+		t.used = time.Now()
+	} else {
+		if c.loading >= pastTreeCacheSize {
+			c.mu.Unlock()
+			return nil, errPastTreesBusy
+		}
+		t = &pastTree{ready: make(chan struct{}), used: time.Now()}
+		c.trees[rev] = t
+		c.loading++
+		c.evict()
+		go c.fill(rev, t)
+	}
+	c.mu.Unlock()
+	select {
+	case <-t.ready:
+		return t.st, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pastTrees) fill(rev int64, t *pastTree) {
+	ctx, cancel := context.WithTimeout(context.Background(), pastTreeTimeout)
+	defer cancel()
+	t.st, t.err = c.load(ctx, rev)
+	c.mu.Lock()
+	c.loading--
+	t.loaded = true
+	if t.err != nil {
+		// Failed loads aren't cached.
+		delete(c.trees, rev)
+	}
+	c.mu.Unlock()
+	close(t.ready)
+}
+
+// evict removes the least recently used loaded trees over the cache size.
+func (c *pastTrees) evict() {
+	for len(c.trees) > pastTreeCacheSize {
+		var oldest *pastTree
+		var oldestRev int64
+		for rev, t := range c.trees {
+			if t.loaded && (oldest == nil || t.used.Before(oldest.used)) {
+				oldest, oldestRev = t, rev
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(c.trees, oldestRev)
+	}
+}
+
+// loadPastTree builds a tree from a keys-only read at revision rev.
+func (s *apiServer) loadPastTree(ctx context.Context, rev int64) (*treeState, error) {
+	start := time.Now()
+	b := nodetree.NewBuilder(nodetree.NewNode("", 0))
+	err := s.rangeKeys(ctx, rev, func(resp *clientv3.GetResponse) {
+		for _, ev := range resp.Kvs {
+			meta := kvMeta(ev)
+			meta.Size = -1 // keys only
+			b.PutNode(string(ev.Key), meta)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	root := b.Root()
+	log.Printf("Loaded %d keys at rev %d in %v", root.Keys, rev, time.Since(start))
+	return &treeState{root: root, rev: rev, etcdReady: true, status: "ready", past: true}, nil
+}
+
+// etcdError responds to a failed etcd request.
+func etcdError(w http.ResponseWriter, what string, err error) {
+	switch err {
+	case errPastTreesBusy:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case rpctypes.ErrPermissionDenied:
+		w.WriteHeader(http.StatusForbidden)
+	case rpctypes.ErrCompacted:
+		http.Error(w, "revision compacted", http.StatusGone)
+	case rpctypes.ErrFutureRev:
+		http.Error(w, "revision not yet reached", http.StatusBadRequest)
+	default:
+		log.Print(what, ": ", err)
+		http.Error(w, "etcd unavailable", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPastTrees(t *testing.T) {
+	var loads atomic.Int32
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	c := newPastTrees(func(ctx context.Context, rev int64) (*treeState, error) {
+		loads.Add(1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		if rev == 99 {
+			return nil, errors.New("failed")
+		}
+		root := nodetree.NewNode("", 0)
+		root.AddNode("/a/"+string(rune('0'+rev)), 0)
+		return &treeState{root: root, rev: rev, past: true}, nil
+	})
+
+	results := make(chan *treeState, 3)
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			st, err := c.get(context.Background(), 1)
+			results <- st
+			errs <- err
+		}()
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the load did not start")
+	}
+	close(release)
+	for range 3 {
+		require.NoError(t, <-errs)
+		require.Equal(t, int64(1), (<-results).rev)
+	}
+	require.Equal(t, int32(1), loads.Load(), "expected concurrent requests to share the load")
+
+	_, err := c.get(context.Background(), 99)
+	require.Error(t, err)
+	_, err = c.get(context.Background(), 99)
+	require.Error(t, err)
+	require.Equal(t, int32(3), loads.Load(), "failed loads expected to not be cached")
+
+	for rev := int64(2); rev <= pastTreeCacheSize+1; rev++ {
+		_, err = c.get(context.Background(), rev)
+		require.NoError(t, err)
+	}
+	require.Len(t, c.trees, pastTreeCacheSize, "expected the cache to be bounded")
+	require.NotContains(t, c.trees, int64(1), "expected the least recently used tree to be evicted")
+
+	s := &apiServer{editable: true}
+	st, err := c.get(context.Background(), 2)
+	require.NoError(t, err)
+	res := s.getSubtreeKeys(st, "", entryOrders[""], nil)
+	require.False(t, res.Editable, "a past tree expected to be read-only")
+	require.Equal(t, int64(2), res.Rev)
+	require.Equal(t, "/a/", res.Keys[0].Key)
+}
+
+func TestPastTreesBusy(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	c := newPastTrees(func(ctx context.Context, rev int64) (*treeState, error) {
+		started <- struct{}{}
+		<-release
+		return &treeState{root: nodetree.NewNode("", 0), rev: rev, past: true}, nil
+	})
+	errs := make(chan error, pastTreeCacheSize)
+	for rev := range int64(pastTreeCacheSize) {
+		go func() {
+			_, err := c.get(context.Background(), rev+1)
+			errs <- err
+		}()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the load did not start")
+		}
+	}
+	_, err := c.get(context.Background(), 100)
+	require.ErrorIs(t, err, errPastTreesBusy, "expected the concurrent loads to be bounded")
+	require.Len(t, c.trees, pastTreeCacheSize, "expected the trees being loaded to not be evicted")
+	close(release)
+	for range pastTreeCacheSize {
+		require.NoError(t, <-errs)
+	}
+	go func() { <-started }()
+	_, err = c.get(context.Background(), 100)
+	require.NoError(t, err, "expected a load once the others completed")
+	require.Len(t, c.trees, pastTreeCacheSize)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentEvent is an update kept in the recent event log.
+type recentEvent struct {
+	Time time.Time `json:"time"`
+	updateMsg
+}
+
+// recentLog is a ring buffer of the latest updates, bounded by count and age.
+// Values are not kept, to keep the memory use predictable.
+type recentLog struct {
+	mu         sync.Mutex
+	events     []recentEvent
+	start, n   int
+	maxAge     time.Duration
+	evictedRev int64 // the latest revision no longer in the log
+	gapRev     int64 // the log is continuous only after this revision
+}
+
+func newRecentLog(size int, maxAge time.Duration) *recentLog {
+	return &recentLog{events: make([]recentEvent, max(size, 0)), maxAge: maxAge}
+}
+
+// add appends an update to the log.
+func (l *recentLog) add(msg updateMsg, now time.Time) {
+	if len(l.events) == 0 {
+		return
+	}
+	msg.Value, msg.PrevValue = nil, nil
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+	if l.n == len(l.events) {
+		l.evictedRev = l.events[l.start].Rev
+		l.start = (l.start + 1) % len(l.events)
+		l.n--
+	}
+	l.events[(l.start+l.n)%len(l.events)] = recentEvent{now, msg}
+	l.n++
+}
+
+// restart tells the log that updates are continuous only from rev onwards,
+// the ones before may have been missed.
+func (l *recentLog) restart(rev int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gapRev = rev - 1
+}
+
+func (l *recentLog) expire(now time.Time) {
+	for l.n > 0 && l.maxAge > 0 && now.Sub(l.events[l.start].Time) > l.maxAge {
+		l.evictedRev = l.events[l.start].Rev
+		l.events[l.start] = recentEvent{}
+		l.start = (l.start + 1) % len(l.events)
+		l.n--
+	}
+}
+
+// query returns the updates under prefix that happened after since and after
+// revision rev.
+func (l *recentLog) query(prefix string, since time.Time, rev int64) []recentEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(time.Now())
+	return l.collect(prefix, since, rev)
+}
+
+// after returns all the updates after revision rev, or false if the log
+// doesn't have all of them.
+func (l *recentLog) after(rev int64) ([]recentEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Expired first, for the evicted revision to include them.
+	l.expire(time.Now())
+	if rev < l.evictedRev || rev < l.gapRev || len(l.events) == 0 {
+		return nil, false
+	}
+	return l.collect("", time.Time{}, rev), true
+}
+
+// collect must be called with the lock held.
+func (l *recentLog) collect(prefix string, since time.Time, rev int64) []recentEvent {
+	res := []recentEvent{}
+	for i := range l.n {
+		ev := &l.events[(l.start+i)%len(l.events)]
+		if ev.Rev > rev && ev.Time.After(since) && strings.HasPrefix(*ev.Key, prefix) {
+			res = append(res, *ev)
+		}
+	}
+	return res
+}
+
+type recentResponse struct {
+	Rev    int64         `json:"rev"`
+	Events []recentEvent `json:"events"`
+}
+
+// handleRecentEvents lists the recent updates. Query parameters:
+// prefix - key prefix;
+// since - a duration (e.g. 15m) or an RFC 3339 time;
+// rev - only updates after this revision, or at - only updates after the
+// revision at an RFC 3339 time.
+func (s *apiServer) handleRecentEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	rev, err := s.revParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	perms := s.permissions(r)
+	events := slices.DeleteFunc(s.recent.query(r.FormValue("prefix"), since, rev), func(ev recentEvent) bool {
+		return !perms.canRead(*ev.Key)
+	})
+	res := recentResponse{Rev: s.snapshot().rev, Events: events}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&res)
+}
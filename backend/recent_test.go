@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentLog(t *testing.T) {
+	l := newRecentLog(3, time.Hour)
+	now := time.Now()
+	add := func(key string, rev int64, at time.Time) {
+		value := "v"
+		l.add(updateMsg{Key: &key, Value: &value, Rev: rev}, at)
+	}
+	revs := func(events []recentEvent) []int64 {
+		res := []int64{}
+		for _, ev := range events {
+			res = append(res, ev.Rev)
+		}
+		return res
+	}
+	add("a/1", 1, now.Add(-2*time.Hour))
+	add("a/2", 2, now.Add(-30*time.Minute))
+	add("b/3", 3, now.Add(-10*time.Minute))
+	require.Equal(t, []int64{2, 3}, revs(l.query("", time.Time{}, 0)), "expected old events to expire")
+	require.Nil(t, l.query("", time.Time{}, 0)[0].Value, "values expected to not be kept")
+	require.Equal(t, []int64{2}, revs(l.query("a/", time.Time{}, 0)), "wrong prefix query")
+	require.Equal(t, []int64{3}, revs(l.query("", now.Add(-15*time.Minute), 0)), "wrong since query")
+	require.Equal(t, []int64{3}, revs(l.query("", time.Time{}, 2)), "wrong rev query")
+
+	for i := range 3 {
+		add(fmt.Sprint("c/", i), int64(4+i), now)
+	}
+	require.Equal(t, []int64{4, 5, 6}, revs(l.query("", time.Time{}, 0)), "expected the oldest events to be evicted")
+	_, ok := l.after(2)
+	require.False(t, ok, "evicted events expected to be missing")
+	events, ok := l.after(4)
+	require.True(t, ok, "events after 4 expected to be complete")
+	require.Equal(t, []int64{5, 6}, revs(events))
+	l.restart(10)
+	_, ok = l.after(6)
+	require.False(t, ok, "events before a restart expected to be missing")
+
+	l = newRecentLog(3, time.Hour)
+	add("a/5", 5, now.Add(-2*time.Hour))
+	_, ok = l.after(4)
+	require.False(t, ok, "expired events expected to be missing")
+}
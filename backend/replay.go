@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// compactedError is returned when the requested revision has been compacted.
+type compactedError struct {
+	CompactRevision int64
+}
+
+func (e *compactedError) Error() string {
+	return fmt.Sprintf("revision compacted, oldest available is %d", e.CompactRevision)
+}
+
+const (
+	replayHoldLimit      = 10000                  // live events held back during a replay
+	replayProgressPeriod = 250 * time.Millisecond // see replayEvents
+)
+
+// replayEvents calls fn for every event under prefix from revision from up to
+// and including revision to, using a temporary watch. Stops at the first error
+// returned by fn.
+func (s *apiServer) replayEvents(ctx context.Context, prefix string, from, to int64, fn func(msg updateMsg) error) error {
+	if from > to {
+		return nil
+	}
+	// A separate watch stream, so that progress requests don't go to other watchers.
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	wch := s.etcd.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(from), clientv3.WithPrevKV(), clientv3.WithCreatedNotify())
+	// A progress notification tells when the watch has caught up, even if
+	// there are no more events. etcd ignores the requests until it has.
+	var progress <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-progress:
+			if err := s.etcd.RequestProgress(ctx); err != nil {
+				return err
+			}
+		case resp, ok := <-wch:
+			if !ok {
+				return errors.New("watch closed")
+			}
+			if resp.CompactRevision != 0 {
+				return &compactedError{resp.CompactRevision}
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			if resp.Created {
+				if err := s.etcd.RequestProgress(ctx); err != nil {
+					return err
+				}
+				ticker := time.NewTicker(replayProgressPeriod)
+				defer ticker.Stop()
+				progress = ticker.C
+			}
+			for _, ev := range resp.Events {
+				if ev.Kv.ModRevision > to {
+					return nil
+				}
+				if err := fn(eventMsg(ev)); err != nil {
+					return err
+				}
+			}
+			// The events of a revision come in one response.
+			if n := len(resp.Events); n > 0 && resp.Events[n-1].Kv.ModRevision == to {
+				return nil
+			}
+			if resp.IsProgressNotify() && resp.Header.Revision >= to {
+				return nil
+			}
+		}
+	}
+}
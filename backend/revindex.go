@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	revIndexFile       = "revisions.jsonl"
+	revIndexResolution = time.Second      // the latest revision per time window is recorded
+	revIndexMaxEntries = 100000           // the older entries are thinned out beyond
+	revProgressPeriod  = 10 * time.Second // how often to learn the revision while idle
+)
+
+// revTime is an observed revision and the time it was observed at.
+type revTime struct {
+	Rev  int64     `json:"rev"`
+	Time time.Time `json:"time"`
+}
+
+// revIndex maps wall-clock time to etcd revisions, as observed by the watch.
+// etcd revisions have no timestamps. The index is persisted when a directory
+// is given. Its size is bounded by thinning out the older half of the entries
+// when full, so the resolution decreases with age.
+type revIndex struct {
+	mu      sync.Mutex
+	entries []revTime // ascending by both Rev and Time
+	written int       // the entries persisted, all but the last one's window is complete
+	path    string
+	f       *os.File
+}
+
+func newRevIndex(dir string) (*revIndex, error) {
+	x := &revIndex{}
+	if dir == "" {
+		return x, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	x.path = filepath.Join(dir, revIndexFile)
+	f, err := os.OpenFile(x.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e revTime
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			x.put(e)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	x.f, x.written = f, len(x.entries)
+	if len(x.entries) > revIndexMaxEntries {
+		if err = x.compact(); err != nil {
+			x.f.Close()
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// Close persists the last entry and closes the file.
+func (x *revIndex) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.f == nil {
+		return nil
+	}
+	err := x.persist(len(x.entries))
+	if cerr := x.f.Close(); err == nil {
+		err = cerr
+	}
+	x.f = nil
+	return err
+}
+
+// put adds an entry, replacing the last one if in the same time window.
+func (x *revIndex) put(e revTime) {
+	if n := len(x.entries); n > 0 {
+		last := x.entries[n-1]
+		if e.Rev <= last.Rev || e.Time.Before(last.Time) {
+			return
+		}
+		if e.Time.Truncate(revIndexResolution).Equal(last.Time.Truncate(revIndexResolution)) {
+			x.entries[n-1] = e
+			return
+		}
+	}
+	x.entries = append(x.entries, e)
+}
+
+// add records that revision rev was current at time t.
+func (x *revIndex) add(rev int64, t time.Time) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.put(revTime{rev, t.Round(0)})
+	if len(x.entries) > revIndexMaxEntries {
+		return x.compact()
+	}
+	return x.persist(len(x.entries) - 1)
+}
+
+// persist writes the entries up to n that are not written yet.
+func (x *revIndex) persist(n int) error {
+	if x.f == nil || n <= x.written {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range x.entries[x.written:n] {
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	if _, err := x.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	x.written = n
+	return nil
+}
+
+// compact drops every other entry of the older half, and rewrites the file.
+func (x *revIndex) compact() error {
+	half := len(x.entries) / 2
+	kept := x.entries[:0]
+	for i, e := range x.entries {
+		if i >= half || i%2 == 0 {
+			kept = append(kept, e)
+		}
+	}
+	x.entries = kept
+	if x.f == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(x.path), revIndexFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // created 0o600, like the index
+	x.f.Close()
+	x.f, x.written = tmp, 0
+	if err = x.persist(len(x.entries) - 1); err == nil {
+		err = os.Rename(tmp.Name(), x.path)
+	}
+	return err
+}
+
+// revAt returns the latest revision observed at or before t.
+func (x *revIndex) revAt(t time.Time) (int64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].Time.After(t) })
+	if i == 0 {
+		return 0, fmt.Errorf("no revision known at %s", t.Format(time.RFC3339))
+	}
+	return x.entries[i-1].Rev, nil
+}
+
+// parseRev parses a revision, given either as a number or as an RFC 3339 time.
+func (s *apiServer) parseRev(v string) (int64, error) {
+	if rev, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return rev, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid revision %q", v)
+	}
+	return s.revs.revAt(t)
+}
+
+// revParam returns the revision requested with either the rev parameter or
+// the at parameter, an RFC 3339 time. Returns 0 if neither is given.
+func (s *apiServer) revParam(r *http.Request) (int64, error) {
+	if v := r.FormValue("rev"); v != "" {
+		rev, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rev < 0 {
+			return 0, fmt.Errorf("invalid rev %q", v)
+		}
+		return rev, nil
+	}
+	if v := r.FormValue("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid at %q", v)
+		}
+		return s.revs.revAt(t)
+	}
+	return 0, nil
+}
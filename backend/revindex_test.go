@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevIndex(t *testing.T) {
+	dir := t.TempDir()
+	x, err := newRevIndex(dir)
+	require.NoError(t, err, "newRevIndex")
+	t0 := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	require.NoError(t, x.add(10, t0))
+	require.NoError(t, x.add(11, t0.Add(100*time.Millisecond)), "expected to replace the entry within the resolution")
+	require.NoError(t, x.add(20, t0.Add(time.Minute)))
+	require.NoError(t, x.add(20, t0.Add(2*time.Minute)), "expected an unchanged revision to be skipped")
+	require.NoError(t, x.add(30, t0.Add(time.Hour)))
+	require.NoError(t, x.Close())
+
+	x, err = newRevIndex(dir)
+	require.NoError(t, err, "reopen")
+	defer x.Close()
+	require.Len(t, x.entries, 3, "expected the entries to be persisted")
+	_, err = x.revAt(t0.Add(-time.Second))
+	require.Error(t, err, "expected no revision before the index")
+	for _, c := range []struct {
+		at  time.Duration
+		rev int64
+	}{{time.Second, 11}, {30 * time.Second, 11}, {time.Minute, 20}, {59 * time.Minute, 20}, {48 * time.Hour, 30}} {
+		rev, err := x.revAt(t0.Add(c.at))
+		require.NoError(t, err)
+		require.Equal(t, c.rev, rev, "wrong revision at +%v", c.at)
+	}
+
+	s := &apiServer{revs: x}
+	rev, err := s.parseRev("15")
+	require.NoError(t, err)
+	require.Equal(t, int64(15), rev, "expected a plain revision")
+	rev, err = s.parseRev("2024-05-01T16:00:01+02:00")
+	require.NoError(t, err)
+	require.Equal(t, int64(11), rev, "expected the latest revision at the time")
+	_, err = s.parseRev("yesterday")
+	require.Error(t, err, "expected an invalid revision")
+}
+
+func TestRevIndexCompact(t *testing.T) {
+	dir := t.TempDir()
+	x, err := newRevIndex(dir)
+	require.NoError(t, err, "newRevIndex")
+	t0 := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	for i := range revIndexMaxEntries + 1 {
+		require.NoError(t, x.add(int64(i+1), t0.Add(time.Duration(i)*time.Second)))
+	}
+	require.Len(t, x.entries, revIndexMaxEntries*3/4+1, "expected the older half to be thinned out")
+	rev, err := x.revAt(t0.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), rev, "expected a lower resolution of the older entries")
+	rev, err = x.revAt(t0.Add(revIndexMaxEntries * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, int64(revIndexMaxEntries+1), rev, "expected the latest entry")
+	require.NoError(t, x.Close())
+
+	x, err = newRevIndex(dir)
+	require.NoError(t, err, "reopen")
+	defer x.Close()
+	require.Len(t, x.entries, revIndexMaxEntries*3/4+1, "expected the compacted entries to be persisted")
+}
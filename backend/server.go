@@ -1,14 +1,17 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,15 +21,44 @@ import (
 )
 
 type apiServer struct {
-	sync.Mutex // a lock for nodetree and revision updates
+	updateLock sync.Mutex // serializes tree updates, readers don't need it
+	state      atomic.Pointer[treeState]
 	etcd       *clientv3.Client
-	root       *nodetree.Node
-	broker     *Broker
-	leases     map[int64]bool
-	rev        int64
+	broker     *Broker[*event]
+	leases     *leaseTracker
+	recent     *recentLog
+	changes    *changeLog // nil unless the local change history is enabled
+	revs       *revIndex
+	acl        *accessRules // nil unless access control is configured
 	editable   bool
 	prefix     string
-	etcdReady  bool
+	pageSize   int64
+	sizeLock   sync.Mutex // serializes loadSizes
+	pastTrees  *pastTrees
+	origins    []string // CORS origins allowed to open websockets besides this server's
+}
+
+// treeState is an immutable snapshot of the keys at a revision.
+type treeState struct {
+	root      *nodetree.Node
+	rev       int64
+	etcdReady bool
+	loading   bool   // initial load in progress, the tree is incomplete
+	status    string // see statusMsg
+	past      bool   // a read-only tree at a past revision, see pastTrees
+}
+
+// statusMsg notifies websocket clients of the etcd connection status:
+// connecting - etcd is not reachable;
+// loading - the tree is being loaded;
+// ready - the tree is loaded and being updated, a client that saw a
+// different status in the meantime should reload it;
+// resyncing - the watch was lost, the tree will be reloaded;
+// compacted - the watch revision was compacted, followed by resyncing.
+type statusMsg struct {
+	Status     string `json:"status"`
+	Rev        int64  `json:"rev,omitempty"`
+	CompactRev int64  `json:"compactrev,omitempty"`
 }
 
 type okResponse struct {
@@ -34,21 +66,89 @@ type okResponse struct {
 }
 
 type updateMsg struct {
-	Key     *string `json:"key"`
-	Value   any     `json:"value,omitempty"`   // undefined in case of omitted value
-	Deleted any     `json:"deleted,omitempty"` // 1 if deleted, undefined otherwise
-	Rev     int64   `json:"rev"`
-	Lease   int64   `json:"lease,omitempty"`
+	Key       *string `json:"key"`
+	Value     any     `json:"value,omitempty"`   // undefined in case of omitted value
+	Deleted   any     `json:"deleted,omitempty"` // 1 if deleted, undefined otherwise
+	Rev       int64   `json:"rev"`
+	Lease     int64   `json:"lease,omitempty"`
+	CreateRev int64   `json:"createrev,omitempty"`
+	Version   int64   `json:"ver,omitempty"`
+	Size      int64   `json:"size,omitempty"`
+	PrevValue any     `json:"prevvalue,omitempty"` // sent along with value only
+	PrevRev   int64   `json:"prevrev,omitempty"`   // sent along with value only
+}
+
+type serverConfig struct {
+	Editable bool
+	Prefix   string
+	PageSize int64 // keys per request of the initial load
+	Recent   *recentLog
+	Changes  *changeLog // nil unless the local change history is enabled
+	Revs     *revIndex
+	ACL      *accessRules // nil unless access control is configured
+	Origins  []string     // CORS origins allowed to open websockets besides this server's
 }
 
-func newServer(etcd *clientv3.Client, editable bool, prefix string) *apiServer {
-	server := apiServer{etcd: etcd, root: nodetree.NewNode("", 0), editable: editable, broker: NewBroker(), prefix: prefix}
+func newServer(etcd *clientv3.Client, cfg serverConfig) *apiServer {
+	server := apiServer{
+		etcd:     etcd,
+		editable: cfg.Editable,
+		broker:   NewBroker[*event](64),
+		prefix:   cfg.Prefix,
+		pageSize: cfg.PageSize,
+		recent:   cfg.Recent,
+		changes:  cfg.Changes,
+		revs:     cfg.Revs,
+		acl:      cfg.ACL,
+		origins:  cfg.Origins,
+	}
+	server.state.Store(&treeState{root: nodetree.NewNode("", 0), status: "connecting"})
+	server.leases = newLeaseTracker(etcdTimeToLive(etcd), server.leasesExpired, server.leasesRenewed)
+	server.pastTrees = newPastTrees(server.loadPastTree)
 	go server.initAndWatch()
 	go server.broker.Start()
-	go server.removeExpiredLoop()
+	go server.leases.run(context.Background())
+	go server.pruneLeasesLoop()
 	return &server
 }
 
+// snapshot returns the current tree state. It must not be modified.
+func (s *apiServer) snapshot() *treeState {
+	return s.state.Load()
+}
+
+// update applies changes to a copy of the current tree state and publishes the
+// result. Readers keep using the previous snapshot until then.
+func (s *apiServer) update(fn func(st *treeState, b *nodetree.Builder)) {
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+	st := *s.state.Load()
+	b := nodetree.NewBuilder(st.root)
+	fn(&st, b)
+	st.root = b.Root()
+	s.state.Store(&st)
+}
+
+// reset replaces the tree state with an empty one.
+func (s *apiServer) reset(status string) {
+	s.updateLock.Lock()
+	s.state.Store(&treeState{root: nodetree.NewNode("", 0), status: s.state.Load().status})
+	s.updateLock.Unlock()
+	s.setStatus(status, 0)
+}
+
+// setStatus updates the status and notifies the clients if it has changed.
+func (s *apiServer) setStatus(status string, compactRev int64) {
+	changed := false
+	s.update(func(st *treeState, _ *nodetree.Builder) {
+		changed = st.status != status
+		st.status = status
+	})
+	if changed || compactRev != 0 {
+		s.broker.Publish(newEvent(statusMsg{Status: status, Rev: s.snapshot().rev, CompactRev: compactRev}))
+	}
+}
+
 func (s *apiServer) handleList(w http.ResponseWriter, r *http.Request) {
 	key := r.FormValue("k")
 	switch r.Method {
@@ -74,50 +174,112 @@ func (s *apiServer) handleOne(w http.ResponseWriter, r *http.Request) {
 }
 
 type Entry struct {
-	Key  string `json:"k"`
-	Type int    `json:"t"` // bit field: 1 = has value, 2 = has children
+	Key        string `json:"k"`
+	Type       int    `json:"t"`                    // bit field: 1 = has value, 2 = has children
+	ModRev     int64  `json:"modrev,omitempty"`     // latest mod revision in the subtree
+	CreateRev  int64  `json:"createrev,omitempty"`  // keys only
+	Version    int64  `json:"ver,omitempty"`        // keys only
+	Size       int64  `json:"size,omitempty"`       // total value size of the subtree
+	Count      int64  `json:"count,omitempty"`      // number of keys in the subtree
+	Lease      int64  `json:"lease,omitempty"`      // keys only
+	TTL        int64  `json:"ttl,omitempty"`        // remaining seconds of the lease, if known
+	GrantedTTL int64  `json:"grantedttl,omitempty"` // granted seconds of the lease, if known
+}
+
+// entryOrders are the supported sort orders of subtree entries, ties are
+// sorted by name.
+var entryOrders = map[string]func(a, b *Entry) int{
+	"":       func(a, b *Entry) int { return 0 },
+	"name":   func(a, b *Entry) int { return 0 },
+	"modrev": func(a, b *Entry) int { return cmp.Compare(b.ModRev, a.ModRev) },
+	"size":   func(a, b *Entry) int { return cmp.Compare(b.Size, a.Size) },
+	"count":  func(a, b *Entry) int { return cmp.Compare(b.Count, a.Count) },
 }
 
 type subtreeResponse struct {
 	Rev      int64   `json:"rev"`
 	Editable bool    `json:"editable,omitempty"`
+	User     string  `json:"user,omitempty"`    // the logged in user, if authenticated
+	Loading  bool    `json:"loading,omitempty"` // the initial load is still in progress
 	Keys     []Entry `json:"keys"`
 }
 
-func (s *apiServer) listSubtree(w http.ResponseWriter, _ *http.Request, key string) {
-	s.Lock()
-	ready := s.etcdReady
-	s.Unlock()
-	if !ready {
+func (s *apiServer) listSubtree(w http.ResponseWriter, r *http.Request, key string) {
+	if st := s.snapshot(); !st.etcdReady && !st.loading {
 		http.Error(w, "etcd not connected", http.StatusServiceUnavailable)
 		return
 	}
-	keys := s.getSubtreeKeys(key)
+	order, found := entryOrders[r.FormValue("sort")]
+	if !found {
+		http.Error(w, "invalid sort order", http.StatusBadRequest)
+		return
+	}
+	rev, err := s.revParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	st := s.snapshot()
+	if rev != 0 && rev < st.rev {
+		if st, err = s.pastTrees.get(r.Context(), rev); err != nil {
+			etcdError(w, "listSubtree", err)
+			return
+		}
+	} else if r.FormValue("sort") == "size" {
+		s.loadSizesFor(r.Context(), key)
+		st = s.snapshot()
+	}
+	keys := s.getSubtreeKeys(st, key, order, s.permissions(r))
+	if u := userFromContext(r.Context()); u != nil && key == "" {
+		keys.User = u.Name
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(*keys)
 }
 
-func (s *apiServer) getSubtreeKeys(prefix string) *subtreeResponse {
-	s.Lock()
-	defer s.Unlock()
-	res := subtreeResponse{Rev: s.rev}
-	if prefix == "" {
+// getSubtreeKeys lists the children of prefix, hiding the ones perms don't
+// allow to read.
+func (s *apiServer) getSubtreeKeys(st *treeState, prefix string, order func(a, b *Entry) int, perms *permissions) *subtreeResponse {
+	res := subtreeResponse{Rev: st.rev, Loading: st.loading}
+	if prefix == "" && !st.past {
 		res.Editable = s.editable
 	}
-	subtree := s.root.GetNode(prefix)
+	subtree := st.root.GetNode(prefix)
 	if subtree != nil && subtree.Count() > 0 {
+		now := time.Now()
 		res.Keys = make([]Entry, 0, subtree.Count())
 		for k, v := range subtree.Children() {
+			readable := v.HasValue && perms.canRead(prefix+k)
+			listable, complete := false, true
+			if v.Count() > 0 {
+				listable, complete = perms.canList(prefix + k)
+			}
+			if !readable && !listable {
+				continue
+			}
 			e := Entry{Key: k, Type: 0}
-			if v.HasValue {
+			if complete {
+				// The aggregates would tell about the hidden keys otherwise.
+				e.ModRev, e.Size, e.Count = v.LastModRevision, v.Bytes, v.Keys
+			}
+			if readable {
 				e.Type |= 1
+				e.CreateRev = v.CreateRevision
+				e.Version = v.Version
+				e.Lease = v.LeaseID
+				if l, found := s.leases.get(v.LeaseID); found && !l.CheckedAt.IsZero() && !st.past {
+					e.TTL, e.GrantedTTL = l.remainingTTL(now), l.GrantedTTL
+				}
 			}
-			if v.Count() > 0 {
+			if listable {
 				e.Type |= 2
 			}
 			res.Keys = append(res.Keys, e)
 		}
 		sort.Slice(res.Keys[:], func(i, j int) bool {
+			if c := order(&res.Keys[i], &res.Keys[j]); c != 0 {
+				return c < 0
+			}
 			return res.Keys[i].Key < res.Keys[j].Key
 		})
 	}
@@ -125,12 +287,20 @@ func (s *apiServer) getSubtreeKeys(prefix string) *subtreeResponse {
 }
 
 func (s *apiServer) getOne(w http.ResponseWriter, r *http.Request, key string) {
+	rev, err := s.revParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.permissions(r).canRead(key) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	resp, err := s.etcd.Get(ctx, key)
+	resp, err := s.etcdFor(r).Get(ctx, key, clientv3.WithRev(rev))
 	if err != nil {
-		log.Printf("Get: %v", err)
-		http.Error(w, "etcd unavailable", http.StatusServiceUnavailable)
+		etcdError(w, "Get", err)
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain") // for ease of debugging, application/octet-stream otherwise
@@ -145,9 +315,7 @@ func (s *apiServer) getOne(w http.ResponseWriter, r *http.Request, key string) {
 }
 
 func (s *apiServer) getLeaseID(key string) clientv3.LeaseID {
-	s.Lock()
-	defer s.Unlock()
-	res := s.root.GetNode(key)
+	res := s.snapshot().root.GetNode(key)
 	if res == nil {
 		return 0
 	}
@@ -161,7 +329,7 @@ func (s *apiServer) updateOne(w http.ResponseWriter, r *http.Request, key string
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if !s.editable {
+	if !s.editable || !s.permissions(r).canWrite(key) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -169,33 +337,44 @@ func (s *apiServer) updateOne(w http.ResponseWriter, r *http.Request, key string
 	leaseID := s.getLeaseID(key)
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	res, err := s.etcd.Put(ctx, key, string(body), clientv3.WithLease(leaseID))
+	res, err := s.etcdFor(r).Put(ctx, key, string(body), clientv3.WithLease(leaseID))
 	if err != nil {
-		log.Printf("Put: %v", err)
-		http.Error(w, "etcd unavailable", http.StatusServiceUnavailable)
+		etcdError(w, "Put", err)
 		return
 	}
+	s.recordUser(res.Header.Revision, r)
 	_ = json.NewEncoder(w).Encode(&okResponse{Rev: res.Header.Revision})
 }
 
 func (s *apiServer) deleteOne(w http.ResponseWriter, r *http.Request, key string) {
-	if !s.editable {
+	if !s.editable || !s.permissions(r).canWrite(key) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	res, err := s.etcd.Delete(ctx, key)
+	res, err := s.etcdFor(r).Delete(ctx, key)
 	if err != nil {
-		log.Printf("Delete: %v", err)
-		http.Error(w, "etcd unavailable", http.StatusServiceUnavailable)
+		etcdError(w, "Delete", err)
 		return
 	}
+	s.recordUser(res.Header.Revision, r)
 	_ = json.NewEncoder(w).Encode(&okResponse{Rev: res.Header.Revision})
 }
 
+// recordUser notes in the change history the user that made the change at rev.
+func (s *apiServer) recordUser(rev int64, r *http.Request) {
+	if s.changes == nil {
+		return
+	}
+	if err := s.changes.recordUser(rev, requestUser(r)); err != nil {
+		log.Print("changes.recordUser: ", err)
+	}
+}
+
 func (s *apiServer) initAndWatch() {
+	var watched int64 // the revision the watch has seen all changes up to
 	for {
 		for delay := 1000; ; delay = min(delay*2, 10000) {
 			if s.loadExisting() == nil {
@@ -205,43 +384,110 @@ func (s *apiServer) initAndWatch() {
 		}
 		ctx, cancel := context.WithCancel(context.Background())
 		go s.healthCheck(ctx, cancel)
-		go s.loadUpdates(s.broker.Subscribe())
-		rev := s.rev
+		go s.requestProgress(ctx)
+		updates := s.broker.Subscribe(treeUpdateBuffer, isUpdate)
+		updatesDone := make(chan struct{})
+		go func() { s.loadUpdates(ctx, updates, cancel); close(updatesDone) }()
+		rev := s.snapshot().rev + 1
 		log.Print("Watching starting from rev ", rev)
-		for resp := range s.etcd.Watch(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev)) {
+		s.recent.restart(rev)
+		if s.changes != nil {
+			if err := s.changes.restart(watched, rev-1, time.Now()); err != nil {
+				log.Print("changes.restart: ", err)
+			}
+		}
+		watched = rev - 1
+		s.addRevTime(rev-1, time.Now())
+		s.setStatus("ready", 0)
+		for resp := range s.etcd.Watch(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithPrevKV()) {
 			if err := resp.Err(); err != nil {
-				// Compacted. Let's reset and retry.
-				// if err == rpctypes.ErrCompacted {
-				// rev = resp.CompactRevision
-				// }
 				log.Print("watch failed: ", err)
+				if resp.CompactRevision != 0 {
+					// Events were lost, the tree has to be reloaded.
+					s.setStatus("compacted", resp.CompactRevision)
+				}
 				break
 			}
-			for _, ev := range resp.Events {
-				key := string(ev.Kv.Key)
+			now := time.Now()
+			if resp.IsProgressNotify() {
+				watched = max(watched, resp.Header.Revision)
+				s.addRevTime(resp.Header.Revision, now)
+				continue
+			}
+			msgs := make([]updateMsg, len(resp.Events))
+			for i, ev := range resp.Events {
 				if rev < ev.Kv.ModRevision {
 					rev = ev.Kv.ModRevision
 				}
-				switch ev.Type {
-				case mvccpb.PUT:
-					value := string(ev.Kv.Value)
-					s.broker.Publish(updateMsg{&key, &value, nil, ev.Kv.ModRevision, ev.Kv.Lease})
-				case mvccpb.DELETE:
-					s.broker.Publish(updateMsg{&key, nil, 1, ev.Kv.ModRevision, ev.Kv.Lease})
+				msgs[i] = eventMsg(ev)
+				s.recent.add(msgs[i], now)
+				s.broker.Publish(newEvent(msgs[i]))
+			}
+			watched = rev
+			s.addRevTime(rev, now)
+			if s.changes != nil {
+				if err := s.changes.record(msgs, now); err != nil {
+					log.Print("changes.record: ", err)
 				}
 			}
 		}
 		cancel()
+		s.broker.Unsubscribe(updates)
+		<-updatesDone
 		log.Print("etcd connection lost, resetting")
-		s.Lock()
-		s.etcdReady = false
-		s.root = nodetree.NewNode("", 0)
-		s.rev = 0
-		s.Unlock()
-		s.broker.Reset()
+		s.reset("resyncing")
 	}
 }
 
+// requestProgress periodically asks the watch for a progress notification, to
+// keep the revision index current while there are no events under the prefix.
+func (s *apiServer) requestProgress(ctx context.Context) {
+	ticker := time.NewTicker(revProgressPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.etcd.RequestProgress(ctx); err != nil && ctx.Err() == nil {
+				log.Print("RequestProgress: ", err)
+			}
+		}
+	}
+}
+
+func (s *apiServer) addRevTime(rev int64, t time.Time) {
+	if err := s.revs.add(rev, t); err != nil {
+		log.Print("revs.add: ", err)
+	}
+}
+
+func (s *apiServer) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "OK")
+	if st := s.snapshot(); st.loading {
+		fmt.Fprintf(w, "loading: %d keys at rev %d\n", st.root.Keys, st.rev)
+	} else if !st.etcdReady {
+		fmt.Fprintln(w, "etcd not connected")
+	}
+}
+
+// eventMsg converts a watch event to an update message.
+func eventMsg(ev *clientv3.Event) updateMsg {
+	key := string(ev.Kv.Key)
+	msg := updateMsg{Key: &key, Rev: ev.Kv.ModRevision, Lease: ev.Kv.Lease}
+	if ev.Type == mvccpb.DELETE {
+		msg.Deleted = 1
+	} else {
+		value := string(ev.Kv.Value)
+		msg.Value, msg.CreateRev, msg.Version, msg.Size = &value, ev.Kv.CreateRevision, ev.Kv.Version, int64(len(value))
+	}
+	if ev.PrevKv != nil {
+		prevValue := string(ev.PrevKv.Value)
+		msg.PrevValue, msg.PrevRev = &prevValue, ev.PrevKv.ModRevision
+	}
+	return msg
+}
+
 func (s *apiServer) healthCheck(ctx context.Context, cancel context.CancelFunc) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -261,52 +507,162 @@ func (s *apiServer) healthCheck(ctx context.Context, cancel context.CancelFunc)
 	}
 }
 
+// loadExisting loads the keys page by page, all pages at the revision of the
+// first one. The partially loaded tree is visible to readers as it grows.
+// Values are not loaded, see loadSizes.
 func (s *apiServer) loadExisting() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	resp, err := s.etcd.Get(ctx, s.prefix, clientv3.WithPrefix())
+	var rev int64
+	err := s.rangeKeys(context.Background(), 0, func(resp *clientv3.GetResponse) {
+		if rev == 0 {
+			rev = resp.Header.Revision
+			log.Print("Loading keys at rev ", rev)
+			s.setStatus("loading", 0)
+		}
+		s.update(func(st *treeState, b *nodetree.Builder) {
+			for _, ev := range resp.Kvs {
+				meta := kvMeta(ev)
+				meta.Size = -1 // keys only
+				b.PutNode(string(ev.Key), meta)
+				s.leases.track(ev.Lease)
+			}
+			st.rev = rev
+			st.loading = resp.More
+			st.etcdReady = !resp.More
+		})
+	})
 	if err != nil {
 		log.Print("loadExisting: ", err)
+		s.reset("connecting")
 		return err
 	}
-	s.Lock()
-	defer s.Unlock()
-	for _, ev := range resp.Kvs {
-		if ev.ModRevision > s.rev {
-			s.rev = ev.ModRevision
+	log.Print("Loaded ", s.snapshot().root.Keys, " keys")
+	return nil
+}
+
+// rangeKeys reads the keys under the prefix at revision rev, or the current
+// revision if 0, in pages, all pinned to the revision of the first page.
+func (s *apiServer) rangeKeys(ctx context.Context, rev int64, fn func(resp *clientv3.GetResponse)) error {
+	key, end := s.prefix, clientv3.GetPrefixRangeEnd(s.prefix)
+	if key == "" {
+		key = "\x00" // the whole keyspace
+	}
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(s.pageSize), clientv3.WithKeysOnly()}
+		if rev != 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		pageCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		resp, err := s.etcd.Get(pageCtx, key, opts...)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
 		}
-		s.root.AddNode(string(ev.Key), ev.Lease)
+		fn(resp)
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
 	}
-	s.etcdReady = true
-	return nil
 }
 
-func (s *apiServer) loadUpdates(input chan any) {
-	for next := range input {
-		msg := next.(updateMsg)
-		s.Lock()
-		if msg.Value != nil {
-			s.root.AddNode(*msg.Key, msg.Lease)
-		} else {
-			s.root.DeleteNode(*msg.Key)
+func kvMeta(kv *mvccpb.KeyValue) nodetree.Meta {
+	return nodetree.Meta{
+		LeaseID:        kv.Lease,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Size:           int64(len(kv.Value)),
+	}
+}
+
+const (
+	maxUpdateBatch   = 1000 // queued updates applied to one snapshot
+	treeUpdateBuffer = 4096 // broker buffer for the tree updates
+)
+
+func isUpdate(ev *event) bool {
+	_, ok := ev.msg.(updateMsg)
+	return ok
+}
+
+// loadUpdates applies the watch events to the tree. If it falls behind, the
+// tree is out of date and the watch is cancelled to reload it.
+func (s *apiServer) loadUpdates(ctx context.Context, input *Subscription[*event], cancelWatch context.CancelFunc) {
+	batch := make([]updateMsg, 0, maxUpdateBatch)
+	for {
+		var next *event
+		select {
+		case <-ctx.Done():
+			return
+		case next = <-input.C:
 		}
-		if msg.Rev > s.rev {
-			s.rev = msg.Rev
+		if next == nil { // closed
+			break
 		}
-		s.Unlock()
+		msg, ok := next.msg.(updateMsg)
+		if !ok {
+			continue
+		}
+		batch = append(batch[:0], msg)
+	drain:
+		for len(batch) < maxUpdateBatch {
+			select {
+			case next, ok := <-input.C:
+				if !ok {
+					break drain
+				}
+				if msg, ok := next.msg.(updateMsg); ok {
+					batch = append(batch, msg)
+				}
+			default:
+				break drain
+			}
+		}
+		s.update(func(st *treeState, b *nodetree.Builder) {
+			for _, msg := range batch {
+				if msg.Value != nil {
+					b.PutNode(*msg.Key, nodetree.Meta{
+						LeaseID:        msg.Lease,
+						CreateRevision: msg.CreateRev,
+						ModRevision:    msg.Rev,
+						Version:        msg.Version,
+						Size:           msg.Size,
+					})
+					s.leases.track(msg.Lease)
+				} else {
+					if node := st.root.GetNode(*msg.Key); node != nil && node.HasValue {
+						s.leases.keyDeleted(node.LeaseID)
+					}
+					b.DeleteNode(*msg.Key)
+				}
+				if msg.Rev > st.rev {
+					st.rev = msg.Rev
+				}
+			}
+		})
+	}
+	if input.Overflowed() {
+		log.Print("loadUpdates fell behind, reloading")
+		cancelWatch()
 	}
-	log.Print("loadUpdates exited")
 }
 
+// closeOutOfSync is the websocket close code sent to a client that missed
+// messages. The client should reload the tree and reconnect.
+const closeOutOfSync = 4000
+
 const (
 	pingPeriod   = 240 * time.Second
 	writeTimeout = 10 * time.Second
 	readTimeout  = writeTimeout + pingPeriod
 )
 
-func readPump(conn *websocket.Conn, keychan chan string) {
-	defer func() { conn.Close(); close(keychan) }()
-	conn.SetReadLimit(1024)
+func readPump(conn *websocket.Conn, reqchan chan clientMsg) {
+	defer func() { conn.Close(); close(reqchan) }()
+	conn.SetReadLimit(64 * 1024)
 	if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
 		log.Print("SetReadDeadline: ", err)
 	}
@@ -319,30 +675,52 @@ func readPump(conn *websocket.Conn, keychan chan string) {
 			}
 			break
 		}
-		var msg updateMsg
+		var msg clientMsg
 		err = json.Unmarshal(msgb, &msg)
-		if err != nil || msg.Key == nil {
+		if err != nil {
 			log.Print("ReadMessage Unmarshal: ", err)
 			continue
 		}
-		keychan <- *msg.Key
+		reqchan <- msg
 	}
 }
 
-func (s *apiServer) handleWebsocket(w http.ResponseWriter, r *http.Request) {
-	s.Lock()
-	ready := s.etcdReady
-	s.Unlock()
-	if !ready {
-		http.Error(w, "etcd not connected", http.StatusServiceUnavailable)
+// closeOutOfSync tells a client that missed messages to reload the tree.
+func (s *apiServer) closeOutOfSync(conn *websocket.Conn) {
+	msgb, _ := json.Marshal(resyncMsg{Resync: true, Rev: s.snapshot().rev})
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
 		return
 	}
+	if err := conn.WriteMessage(websocket.TextMessage, msgb); err != nil {
+		return
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeOutOfSync, "out of sync"))
+}
+
+// handleWebsocket streams updates to a client. Query parameters:
+// rev - the revision the client has, the updates since are replayed, or a
+// resync message sent if they are no longer known;
+// coalesce - a window in ms within which only the latest update per key is
+// sent. Deletes and values the client asked for are never held back, and the
+// updates held back are sent before them, so revisions never go backwards.
+func (s *apiServer) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	var coalesceWindow int
+	if v := r.FormValue("coalesce"); v != "" {
+		var err error
+		if coalesceWindow, err = strconv.Atoi(v); err != nil || coalesceWindow < 0 {
+			http.Error(w, "invalid coalesce", http.StatusBadRequest)
+			return
+		}
+		coalesceWindow = min(coalesceWindow, maxCoalesceWindow)
+	}
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:    1024,
 		WriteBufferSize:   4096,
 		EnableCompression: true,
 		CheckOrigin: func(r *http.Request) bool {
-			return true // TODO implement cors checking
+			// The session cookie comes along, only pages of this server or
+			// of the CORS origins may read the stream.
+			return sameOrigin(r) || originAllowed(r.Header.Get("Origin"), s.origins)
 		},
 	}
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -351,110 +729,206 @@ func (s *apiServer) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
-	keychan := make(chan string, 64)
-	rev := r.URL.Query()["rev"]
-	if len(rev) > 0 && rev[0] != "0" {
-		i, _ := strconv.ParseInt(rev[0], 10, 64)
-		if i != s.rev {
-			//TODO implement rev
-			log.Printf("todo: handleWebsocket requesting rev %v - ignored, will continue from %d", rev[0], s.rev)
+	reqchan := make(chan clientMsg, 64)
+	go readPump(conn, reqchan)
+	sub := subscription{perms: s.permissions(r)}
+	input := s.broker.Subscribe(0, sub.accepts)
+	defer s.broker.Unsubscribe(input)
+	// Replay the updates the client missed, if still in the recent event log.
+	var replayed []recentEvent
+	var resync bool
+	rev, _ := strconv.ParseInt(r.FormValue("rev"), 10, 64)
+	if cur := s.snapshot().rev; rev > 0 && rev < cur {
+		var ok bool
+		if replayed, ok = s.recent.after(rev); !ok {
+			log.Printf("handleWebsocket requesting rev %d - not available, will continue from %d", rev, cur)
+			resync = true
 		}
 	}
-	go readPump(conn, keychan)
-	input := s.broker.Subscribe()
-	defer s.broker.Unsubscribe(input)
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
-	key := ""
-loop:
-	for {
-		var err error
-		select {
-		case newkey, ok := <-keychan:
-			if !ok {
-				break loop
-			}
-			key = newkey
-		case next, ok := <-input:
-			if !ok {
-				break loop
-			}
-			msg := next.(updateMsg)
-			if msg.Value == nil {
-				msg.Deleted = 1
-			}
-			if key != *msg.Key {
-				msg.Value = nil
+	var pending *coalescer
+	var flushC <-chan time.Time
+	if coalesceWindow > 0 {
+		pending = newCoalescer()
+		flushTicker := time.NewTicker(time.Duration(coalesceWindow) * time.Millisecond)
+		defer flushTicker.Stop()
+		flushC = flushTicker.C
+	}
+	send := func(ev *event) error {
+		msgb, ok := sub.encode(ev)
+		if !ok {
+			return nil
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, msgb)
+	}
+	flush := func() error {
+		for _, ev := range pending.flush() {
+			if err := send(ev); err != nil {
+				return err
 			}
-			msgb, err2 := json.Marshal(msg)
-			if err2 != nil {
-				log.Print("json.Marshal: ", err2)
-				break loop
+		}
+		return nil
+	}
+	// the current status first, changes come through the broker
+	st := s.snapshot()
+	var release func() []*event
+	if len(replayed) > 0 {
+		// The live events are held back meanwhile, and sent after.
+		release = input.Hold(replayHoldLimit)
+	}
+	if resync {
+		// The client missed updates and has to reload the tree, once the
+		// status says etcd is ready.
+		err = send(newEvent(resyncMsg{Resync: true, Rev: st.rev}))
+	}
+	if err == nil {
+		err = send(newEvent(statusMsg{Status: st.status, Rev: st.rev}))
+	}
+	var replayedRev int64
+	for _, ev := range replayed {
+		if err != nil {
+			break
+		}
+		err = send(newEvent(ev.updateMsg))
+		replayedRev = ev.Rev
+	}
+	var held []*event
+	if release != nil {
+		held = release()
+	}
+loop:
+	for err == nil {
+		var next *event
+		if len(held) > 0 {
+			next, held = held[0], held[1:]
+		} else {
+			select {
+			case req, ok := <-reqchan:
+				if !ok {
+					break loop
+				}
+				sub.apply(&req)
+				continue
+			case ev, ok := <-input.C:
+				if !ok {
+					if input.Overflowed() {
+						s.closeOutOfSync(conn)
+					}
+					break loop
+				}
+				next = ev
+			case <-flushC:
+				err = flush()
+				continue
+			case <-ticker.C:
+				if err = conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+					log.Print("SetWriteDeadline: ", err)
+					break loop
+				}
+				err = conn.WriteMessage(websocket.PingMessage, nil)
+				continue
 			}
-			if err = conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-				log.Print("SetWriteDeadline: ", err)
-				break loop
+		}
+		msg, ok := next.msg.(updateMsg)
+		if ok && msg.Rev <= replayedRev {
+			continue // replayed already
+		}
+		if pending != nil {
+			if ok && msg.Value != nil && !sub.wantsValue(*msg.Key) {
+				pending.add(*msg.Key, next)
+				continue
 			}
-			err = conn.WriteMessage(websocket.TextMessage, msgb)
-		case <-ticker.C:
-			if err = conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-				log.Print("SetWriteDeadline: ", err)
-				break loop
+			if ok {
+				pending.remove(*msg.Key) // superseded
 			}
-			err = conn.WriteMessage(websocket.PingMessage, nil)
-		}
-		if err != nil {
-			if err != websocket.ErrCloseSent {
-				log.Print("WriteMessage: ", err)
+			// The held back updates have lower revisions and go first, a
+			// client resuming from the latest revision it saw misses none.
+			if _, status := next.msg.(statusMsg); ok || status {
+				if err = flush(); err != nil {
+					break
+				}
 			}
-			break
 		}
+		err = send(next)
+	}
+	if err != nil && err != websocket.ErrCloseSent {
+		log.Print("WriteMessage: ", err)
 	}
 }
 
-func (s *apiServer) removeExpiredLoop() {
-	for {
-		now := time.Now().UTC().Unix()
-		delay := 300 - now%300
-		time.Sleep(time.Duration(delay) * time.Second)
-		s.removeExpired()
+// leaseMsg notifies websocket clients of a lease event.
+type leaseMsg struct {
+	Lease      int64  `json:"lease"`
+	Event      string `json:"event"` // "keepalive" or "expired"
+	TTL        int64  `json:"ttl"`
+	GrantedTTL int64  `json:"grantedttl"`
+}
+
+func (s *apiServer) leasesExpired(ids []int64) {
+	s.removeLeaseKeys(ids)
+	for _, id := range ids {
+		s.broker.Publish(newEvent(leaseMsg{Lease: id, Event: "expired"}))
 	}
 }
 
-func (s *apiServer) removeExpired() {
-	s.Lock()
-	defer s.Unlock()
-	s.leases = make(map[int64]bool)
-	s.removeExpiredRecursive(s.root)
-	s.leases = nil
+func (s *apiServer) leasesRenewed(leases []leaseInfo) {
+	for _, l := range leases {
+		s.broker.Publish(newEvent(leaseMsg{Lease: l.ID, Event: "keepalive", TTL: l.TTL, GrantedTTL: l.GrantedTTL}))
+	}
 }
 
-func (s *apiServer) removeExpiredRecursive(node *nodetree.Node) {
-	for k, sub := range node.Children() {
-		if s.isExpired(sub.LeaseID) {
-			node.DeleteNode(k)
-			continue
+// removeLeaseKeys removes the keys attached to expired leases. Normally etcd
+// reports these as deleted, this is a safety net in case the events were missed.
+func (s *apiServer) removeLeaseKeys(ids []int64) {
+	expired := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		expired[id] = true
+	}
+	var keys []string
+	walkKeys(s.snapshot().root, "", func(key string, node *nodetree.Node) {
+		if expired[node.LeaseID] {
+			keys = append(keys, key)
 		}
-		s.removeExpiredRecursive(sub)
+	})
+	if len(keys) == 0 {
+		return
 	}
+	s.update(func(st *treeState, b *nodetree.Builder) {
+		for _, key := range keys {
+			// the key may have been updated with a new lease in the meantime
+			if node := st.root.GetNode(key); node != nil && expired[node.LeaseID] {
+				b.DeleteNode(key)
+			}
+		}
+	})
 }
 
-func (s *apiServer) isExpired(leaseID int64) bool {
-	if leaseID <= 0 {
-		return false
+// pruneLeasesLoop periodically stops tracking leases no longer used by any key.
+func (s *apiServer) pruneLeasesLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		since := time.Now()
+		used := make(map[int64]bool)
+		walkKeys(s.snapshot().root, "", func(_ string, node *nodetree.Node) {
+			if node.LeaseID > 0 {
+				used[node.LeaseID] = true
+			}
+		})
+		s.leases.retain(used, since)
 	}
-	expired, found := s.leases[leaseID]
-	if !found {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		ttl, err := s.etcd.TimeToLive(ctx, clientv3.LeaseID(leaseID))
-		cancel()
-		if err != nil {
-			log.Printf("TimeToLive %d: %v", leaseID, err)
-			expired = false
-		} else {
-			expired = ttl.TTL <= 0
+}
+
+// walkKeys calls fn for every key under node.
+func walkKeys(node *nodetree.Node, path string, fn func(key string, node *nodetree.Node)) {
+	for k, sub := range node.Children() {
+		if sub.HasValue {
+			fn(path+k, sub)
 		}
-		s.leases[leaseID] = expired
+		walkKeys(sub, path+k, fn)
 	}
-	return expired
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// sizePageSize is the number of values fetched per request by loadSizes.
+// Kept small, as values can be large.
+const sizePageSize = 500
+
+// loadSizesFor loads unknown value sizes under prefix, logging any error.
+// On error the sizes remain partially unknown.
+func (s *apiServer) loadSizesFor(ctx context.Context, prefix string) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := s.loadSizes(ctx, prefix); err != nil {
+		log.Printf("loadSizes %q: %v", prefix, err)
+	}
+}
+
+// loadSizes fetches the values of keys under prefix whose size is unknown
+// (the initial load is keys-only) and records their sizes in the tree.
+// Values are not retained. Keys modified in the meantime already have a size
+// from the watch and are skipped. Each page starts from the first key still
+// unsized, so that the calls that run out of time are continued by the next.
+func (s *apiServer) loadSizes(ctx context.Context, prefix string) error {
+	s.sizeLock.Lock()
+	defer s.sizeLock.Unlock()
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	if strings.HasPrefix(s.prefix, prefix) {
+		end = clientv3.GetPrefixRangeEnd(s.prefix) // the tree only has the keys under PREFIX
+	}
+	var key string
+	for {
+		node := s.snapshot().root.GetNode(prefix)
+		if node == nil {
+			return nil
+		}
+		path, found := node.FirstUnsized()
+		if !found {
+			return nil
+		}
+		// Past the keys of the previous page, which may remain unsized.
+		key = max(key, prefix+path)
+		resp, err := s.etcd.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(sizePageSize))
+		if err != nil {
+			return err
+		}
+		s.update(func(st *treeState, b *nodetree.Builder) {
+			for _, kv := range resp.Kvs {
+				k := string(kv.Key)
+				if node := st.root.GetNode(k); node != nil && node.HasValue && node.Size < 0 && node.ModRevision == kv.ModRevision {
+					meta := node.Meta
+					meta.Size = int64(len(kv.Value))
+					b.PutNode(k, meta)
+				}
+			}
+		})
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
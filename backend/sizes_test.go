@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeKV serves Get from a sorted list of keys, 2 per page, failing once
+// calls pages are served.
+type fakeKV struct {
+	clientv3.KV
+	kvs    []*mvccpb.KeyValue
+	calls  int
+	starts []string
+}
+
+func (f *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if f.calls == 0 {
+		return nil, errors.New("out of time")
+	}
+	f.calls--
+	f.starts = append(f.starts, key)
+	end := string(clientv3.OpGet(key, opts...).RangeBytes())
+	i := sort.Search(len(f.kvs), func(i int) bool { return string(f.kvs[i].Key) >= key })
+	resp := &clientv3.GetResponse{}
+	for ; i < len(f.kvs) && string(f.kvs[i].Key) < end; i++ {
+		if len(resp.Kvs) == 2 {
+			resp.More = true
+			break
+		}
+		resp.Kvs = append(resp.Kvs, f.kvs[i])
+	}
+	return resp, nil
+}
+
+func TestLoadSizes(t *testing.T) {
+	kv := &fakeKV{}
+	root := nodetree.NewNode("", 0)
+	for i, key := range []string{"/app/a", "/app/b", "/app/c", "/app/d", "/app/e"} {
+		kv.kvs = append(kv.kvs, &mvccpb.KeyValue{Key: []byte(key), Value: make([]byte, i), ModRevision: 1})
+		root.PutNode(key, nodetree.Meta{ModRevision: 1, Size: -1})
+	}
+	s := &apiServer{etcd: &clientv3.Client{KV: kv}, prefix: "/app/"}
+	s.state.Store(&treeState{root: root, rev: 1})
+
+	kv.calls = 1
+	require.Error(t, s.loadSizes(context.Background(), ""))
+	require.Equal(t, int64(3), s.snapshot().root.Unsized, "expected the first page to be sized")
+	kv.calls = 1
+	require.Error(t, s.loadSizes(context.Background(), ""))
+	kv.calls = 1
+	require.NoError(t, s.loadSizes(context.Background(), ""))
+	require.Equal(t, []string{"/app/a", "/app/c", "/app/e"}, kv.starts, "expected each call to continue from the first unsized key")
+	require.Zero(t, s.snapshot().root.Unsized)
+	require.Equal(t, int64(0+1+2+3+4), s.snapshot().root.Bytes)
+}
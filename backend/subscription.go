@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	maxSubscriptions = 1000 // prefixes a client can subscribe to
+	maxPins          = 100  // keys a client can receive values of
+)
+
+// clientMsg is a request sent by a websocket client.
+type clientMsg struct {
+	Key         *string  `json:"key"`         // the key whose value is being viewed
+	Subscribe   []string `json:"subscribe"`   // key prefixes to receive events for
+	Unsubscribe []string `json:"unsubscribe"` // key prefixes to stop receiving events for
+	Pin         []string `json:"pin"`         // keys to receive values of, in addition to key
+	Unpin       []string `json:"unpin"`       // keys to stop receiving values of
+}
+
+// subscription selects the events sent to a client.
+// Until the client subscribes to a prefix it receives events for all keys.
+// Safe for concurrent use, it's also used as a broker filter.
+type subscription struct {
+	mu       sync.Mutex
+	key      string          // the key whose value is sent
+	prefixes map[string]bool // nil = all keys
+	pinned   map[string]bool // more keys whose values are sent
+	perms    *permissions    // keys the client may see, nil = all
+}
+
+// apply updates the subscription with a client request.
+func (sub *subscription) apply(msg *clientMsg) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if msg.Key != nil {
+		sub.key = *msg.Key
+	}
+	if len(msg.Subscribe) > 0 && sub.prefixes == nil {
+		sub.prefixes = make(map[string]bool)
+	}
+	for _, p := range msg.Subscribe {
+		if len(sub.prefixes) >= maxSubscriptions {
+			log.Print("Too many subscriptions - ignored")
+			break
+		}
+		sub.prefixes[p] = true
+	}
+	for _, p := range msg.Unsubscribe {
+		delete(sub.prefixes, p)
+	}
+	if len(msg.Pin) > 0 && sub.pinned == nil {
+		sub.pinned = make(map[string]bool)
+	}
+	for _, k := range msg.Pin {
+		if len(sub.pinned) >= maxPins {
+			log.Print("Too many pinned keys - ignored")
+			break
+		}
+		sub.pinned[k] = true
+	}
+	for _, k := range msg.Unpin {
+		delete(sub.pinned, k)
+	}
+}
+
+// wantsValue tells whether the client receives values for key.
+func (sub *subscription) wantsValue(key string) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.wantsValueLocked(key)
+}
+
+func (sub *subscription) wantsValueLocked(key string) bool {
+	return key == sub.key || sub.pinned[key]
+}
+
+// matches tells whether the client is interested in events for key.
+func (sub *subscription) matches(key string) bool {
+	if !sub.perms.canRead(key) {
+		return false
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.prefixes == nil || sub.wantsValueLocked(key) {
+		return true
+	}
+	for p := range sub.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts is the broker filter of the subscription.
+func (sub *subscription) accepts(ev *event) bool {
+	msg, ok := ev.msg.(updateMsg)
+	return !ok || sub.matches(*msg.Key)
+}
+
+// encode returns the event as sent to the client. Returns false if the client
+// is not interested in it.
+func (sub *subscription) encode(ev *event) ([]byte, bool) {
+	msg, ok := ev.msg.(updateMsg)
+	if !ok {
+		return ev.encoded(true), true
+	}
+	if !sub.matches(*msg.Key) {
+		return nil, false
+	}
+	return ev.encoded(sub.wantsValue(*msg.Key)), true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscription(t *testing.T) {
+	var sub subscription
+	require.True(t, sub.matches("a/b"), "expected to match everything by default")
+
+	key := "x/y"
+	sub.apply(&clientMsg{Key: &key, Subscribe: []string{"a/", "b/c/"}})
+	require.True(t, sub.matches("a/b"), "a/b expected to match")
+	require.True(t, sub.matches("b/c/d"), "b/c/d expected to match")
+	require.False(t, sub.matches("b/d"), "b/d expected to not match")
+	require.True(t, sub.matches("x/y"), "the viewed key expected to match")
+
+	sub.apply(&clientMsg{Unsubscribe: []string{"a/"}})
+	require.False(t, sub.matches("a/b"), "a/b expected to not match after unsubscribe")
+	require.True(t, sub.matches("b/c/d"), "b/c/d expected to match")
+
+	sub.apply(&clientMsg{Unsubscribe: []string{"b/c/"}})
+	require.False(t, sub.matches("b/c/d"), "expected to match nothing after unsubscribing all")
+}
+
+func TestPins(t *testing.T) {
+	var sub subscription
+	key := "a"
+	sub.apply(&clientMsg{Key: &key, Subscribe: []string{"x/"}, Pin: []string{"b", "c"}})
+	require.True(t, sub.wantsValue("a"), "the viewed key expected to have a value")
+	require.True(t, sub.wantsValue("b"), "pinned key expected to have a value")
+	require.False(t, sub.wantsValue("x/y"), "x/y expected to not have a value")
+	require.True(t, sub.matches("c"), "pinned key expected to match outside of subscriptions")
+
+	sub.apply(&clientMsg{Unpin: []string{"b"}})
+	require.False(t, sub.wantsValue("b"), "unpinned key expected to not have a value")
+
+	for i := range maxPins + 10 {
+		sub.apply(&clientMsg{Pin: []string{fmt.Sprint("k", i)}})
+	}
+	require.Len(t, sub.pinned, maxPins, "pins expected to be capped")
+}
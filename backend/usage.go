@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+)
+
+const (
+	defaultUsageTop = 20
+	maxUsageTop     = 1000
+)
+
+type usageEntry struct {
+	Key   string `json:"k"`
+	Size  int64  `json:"size"`  // total value size of the subtree
+	Count int64  `json:"count"` // number of keys in the subtree
+}
+
+type usageResponse struct {
+	Rev     int64        `json:"rev"`
+	Size    int64        `json:"size"`
+	Count   int64        `json:"count"`
+	Unsized int64        `json:"unsized,omitempty"` // number of keys with an unknown size
+	BySize  []usageEntry `json:"bySize"`
+	ByCount []usageEntry `json:"byCount"`
+}
+
+func (s *apiServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	top := defaultUsageTop
+	if v := r.FormValue("top"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i <= 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		top = min(i, maxUsageTop)
+	}
+	if st := s.snapshot(); !st.etcdReady && !st.loading {
+		http.Error(w, "etcd not connected", http.StatusServiceUnavailable)
+		return
+	}
+	if _, complete := s.permissions(r).canList(r.FormValue("k")); !complete {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.loadSizesFor(r.Context(), r.FormValue("k"))
+	res := s.getUsage(r.FormValue("k"), top)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// getUsage finds the largest subtrees under prefix, by value size and by number of keys.
+func (s *apiServer) getUsage(prefix string, top int) *usageResponse {
+	st := s.snapshot()
+	res := usageResponse{Rev: st.rev, BySize: []usageEntry{}, ByCount: []usageEntry{}}
+	subtree := st.root.GetNode(prefix)
+	if subtree == nil {
+		return &res
+	}
+	res.Size, res.Count, res.Unsized = subtree.Bytes, subtree.Keys, subtree.Unsized
+	bySize := &usageHeap{less: func(a, b *usageEntry) bool { return a.Size < b.Size || a.Size == b.Size && a.Key > b.Key }}
+	byCount := &usageHeap{less: func(a, b *usageEntry) bool { return a.Count < b.Count || a.Count == b.Count && a.Key > b.Key }}
+	var walk func(node *nodetree.Node, path string)
+	walk = func(node *nodetree.Node, path string) {
+		for k, sub := range node.Children() {
+			e := usageEntry{Key: path + k, Size: sub.Bytes, Count: sub.Keys}
+			bySize.pushTop(e, top)
+			byCount.pushTop(e, top)
+			walk(sub, e.Key)
+		}
+	}
+	walk(subtree, prefix)
+	res.BySize = bySize.sorted(res.BySize)
+	res.ByCount = byCount.sorted(res.ByCount)
+	return &res
+}
+
+// usageHeap is a min-heap that keeps the largest entries seen so far.
+type usageHeap struct {
+	entries []usageEntry
+	less    func(a, b *usageEntry) bool
+}
+
+func (h *usageHeap) Len() int           { return len(h.entries) }
+func (h *usageHeap) Less(i, j int) bool { return h.less(&h.entries[i], &h.entries[j]) }
+func (h *usageHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *usageHeap) Push(x any)         { h.entries = append(h.entries, x.(usageEntry)) }
+func (h *usageHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+func (h *usageHeap) pushTop(e usageEntry, top int) {
+	if h.Len() < top {
+		heap.Push(h, e)
+	} else if h.less(&h.entries[0], &e) {
+		h.entries[0] = e
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted returns the entries largest first.
+func (h *usageHeap) sorted(res []usageEntry) []usageEntry {
+	res = append(res, h.entries...)
+	sort.Slice(res, func(i, j int) bool { return h.less(&res[j], &res[i]) })
+	return res
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rustyx/etcdv3-browser/nodetree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUsage(t *testing.T) {
+	root := nodetree.NewNode("", 0)
+	root.PutNode("a/b/c", nodetree.Meta{Size: 100})
+	root.PutNode("a/b/d", nodetree.Meta{Size: 1})
+	root.PutNode("a/e", nodetree.Meta{Size: 10})
+	root.PutNode("f/g", nodetree.Meta{Size: 50})
+	s := apiServer{}
+	s.state.Store(&treeState{root: root, rev: 5, etcdReady: true})
+
+	res := s.getUsage("", 3)
+	require.Equal(t, int64(161), res.Size, "wrong total size")
+	require.Equal(t, int64(4), res.Count, "wrong total count")
+	require.Equal(t, []usageEntry{{"a/", 111, 3}, {"a/b/", 101, 2}, {"a/b/c", 100, 1}}, res.BySize)
+	require.Equal(t, []usageEntry{{"a/", 111, 3}, {"a/b/", 101, 2}, {"a/b/c", 100, 1}}, res.ByCount)
+
+	res = s.getUsage("a/b/", 5)
+	require.Equal(t, []usageEntry{{"a/b/c", 100, 1}, {"a/b/d", 1, 1}}, res.BySize)
+	require.Empty(t, s.getUsage("x/", 5).BySize, "expected no entries for a missing prefix")
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func env(key string, defaultValue string, _ string) string {
@@ -28,6 +29,32 @@ func envInt(key string, defaultValue int, _ string) int {
 	return i
 }
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "OK")
+// sameOrigin tells whether a request comes from a page of this server: its
+// Origin, or without one its Referer, has the request's host. A request with
+// neither is not from a browser page.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// originAllowed tells whether origin matches one of the patterns, each of
+// which can have a * wildcard, as in the CORS setting.
+func originAllowed(origin string, patterns []string) bool {
+	for _, p := range patterns {
+		if before, after, found := strings.Cut(p, "*"); found {
+			if len(origin) >= len(before)+len(after) && strings.HasPrefix(origin, before) && strings.HasSuffix(origin, after) {
+				return true
+			}
+		} else if origin == p {
+			return true
+		}
+	}
+	return false
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"testing"
@@ -35,3 +36,18 @@ func TestEnvIntCrasher(t *testing.T) {
 	}
 	t.Fatalf("process ran with err %v, want exit status 1", err)
 }
+
+func TestOrigin(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://browser.example/login", nil)
+	require.True(t, sameOrigin(r), "expected a request without an origin to be allowed")
+	r.Header.Set("Referer", "http://browser.example/login")
+	require.True(t, sameOrigin(r), "expected the referer to be checked without an origin")
+	r.Header.Set("Origin", "http://evil.example")
+	require.False(t, sameOrigin(r), "expected another origin to be rejected")
+
+	patterns := []string{"http://localhost:*", "https://ui.example"}
+	require.True(t, originAllowed("http://localhost:8080", patterns))
+	require.True(t, originAllowed("https://ui.example", patterns))
+	require.False(t, originAllowed("https://ui.example.evil", patterns))
+	require.False(t, originAllowed("http://evil.example", patterns))
+}